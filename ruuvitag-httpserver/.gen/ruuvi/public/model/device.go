@@ -7,8 +7,16 @@
 
 package model
 
+import (
+	"time"
+)
+
 type Device struct {
-	ID    int32 `sql:"primary_key"`
-	Mac   string
-	Label string
+	ID        int32 `sql:"primary_key"`
+	Mac       string
+	Label     string
+	Status    string
+	FirstSeen *time.Time
+	LastSeen  *time.Time
+	Rssi      *int32
 }
@@ -26,4 +26,14 @@ type Measurement struct {
 	MovementCounter           *int64
 	MeasurementSequenceNumber *int64
 	Rssi                      *int32
+	Gateway                   *string
+	SampleCount               int32
+	TemperatureCount          *int32
+	HumidityCount             *int32
+	PressureCount             *int32
+	AccelerationXCount        *int32
+	AccelerationYCount        *int32
+	AccelerationZCount        *int32
+	BatteryVoltageCount       *int32
+	RssiCount                 *int32
 }
@@ -17,9 +17,13 @@ type deviceTable struct {
 	postgres.Table
 
 	// Columns
-	ID    postgres.ColumnInteger
-	Mac   postgres.ColumnString
-	Label postgres.ColumnString
+	ID        postgres.ColumnInteger
+	Mac       postgres.ColumnString
+	Label     postgres.ColumnString
+	Status    postgres.ColumnString
+	FirstSeen postgres.ColumnTimestampz
+	LastSeen  postgres.ColumnTimestampz
+	Rssi      postgres.ColumnInteger
 
 	AllColumns     postgres.ColumnList
 	MutableColumns postgres.ColumnList
@@ -61,21 +65,29 @@ func newDeviceTable(schemaName, tableName, alias string) *DeviceTable {
 
 func newDeviceTableImpl(schemaName, tableName, alias string) deviceTable {
 	var (
-		IDColumn       = postgres.IntegerColumn("id")
-		MacColumn      = postgres.StringColumn("mac")
-		LabelColumn    = postgres.StringColumn("label")
-		allColumns     = postgres.ColumnList{IDColumn, MacColumn, LabelColumn}
-		mutableColumns = postgres.ColumnList{MacColumn, LabelColumn}
-		defaultColumns = postgres.ColumnList{IDColumn}
+		IDColumn        = postgres.IntegerColumn("id")
+		MacColumn       = postgres.StringColumn("mac")
+		LabelColumn     = postgres.StringColumn("label")
+		StatusColumn    = postgres.StringColumn("status")
+		FirstSeenColumn = postgres.TimestampzColumn("first_seen")
+		LastSeenColumn  = postgres.TimestampzColumn("last_seen")
+		RssiColumn      = postgres.IntegerColumn("rssi")
+		allColumns      = postgres.ColumnList{IDColumn, MacColumn, LabelColumn, StatusColumn, FirstSeenColumn, LastSeenColumn, RssiColumn}
+		mutableColumns  = postgres.ColumnList{MacColumn, LabelColumn, StatusColumn, FirstSeenColumn, LastSeenColumn, RssiColumn}
+		defaultColumns  = postgres.ColumnList{IDColumn, StatusColumn}
 	)
 
 	return deviceTable{
 		Table: postgres.NewTable(schemaName, tableName, alias, allColumns...),
 
 		//Columns
-		ID:    IDColumn,
-		Mac:   MacColumn,
-		Label: LabelColumn,
+		ID:        IDColumn,
+		Mac:       MacColumn,
+		Label:     LabelColumn,
+		Status:    StatusColumn,
+		FirstSeen: FirstSeenColumn,
+		LastSeen:  LastSeenColumn,
+		Rssi:      RssiColumn,
 
 		AllColumns:     allColumns,
 		MutableColumns: mutableColumns,
@@ -31,6 +31,16 @@ type measurementTable struct {
 	MovementCounter           postgres.ColumnInteger
 	MeasurementSequenceNumber postgres.ColumnInteger
 	Rssi                      postgres.ColumnInteger
+	Gateway                   postgres.ColumnString
+	SampleCount               postgres.ColumnInteger
+	TemperatureCount          postgres.ColumnInteger
+	HumidityCount             postgres.ColumnInteger
+	PressureCount             postgres.ColumnInteger
+	AccelerationXCount        postgres.ColumnInteger
+	AccelerationYCount        postgres.ColumnInteger
+	AccelerationZCount        postgres.ColumnInteger
+	BatteryVoltageCount       postgres.ColumnInteger
+	RssiCount                 postgres.ColumnInteger
 
 	AllColumns     postgres.ColumnList
 	MutableColumns postgres.ColumnList
@@ -86,9 +96,19 @@ func newMeasurementTableImpl(schemaName, tableName, alias string) measurementTab
 		MovementCounterColumn           = postgres.IntegerColumn("movement_counter")
 		MeasurementSequenceNumberColumn = postgres.IntegerColumn("measurement_sequence_number")
 		RssiColumn                      = postgres.IntegerColumn("rssi")
-		allColumns                      = postgres.ColumnList{IDColumn, DeviceIDColumn, CreatedAtColumn, TemperatureColumn, HumidityColumn, PressureColumn, AccelerationXColumn, AccelerationYColumn, AccelerationZColumn, BatteryVoltageColumn, TxPowerColumn, MovementCounterColumn, MeasurementSequenceNumberColumn, RssiColumn}
-		mutableColumns                  = postgres.ColumnList{DeviceIDColumn, CreatedAtColumn, TemperatureColumn, HumidityColumn, PressureColumn, AccelerationXColumn, AccelerationYColumn, AccelerationZColumn, BatteryVoltageColumn, TxPowerColumn, MovementCounterColumn, MeasurementSequenceNumberColumn, RssiColumn}
-		defaultColumns                  = postgres.ColumnList{IDColumn}
+		GatewayColumn                   = postgres.StringColumn("gateway")
+		SampleCountColumn               = postgres.IntegerColumn("sample_count")
+		TemperatureCountColumn          = postgres.IntegerColumn("temperature_count")
+		HumidityCountColumn             = postgres.IntegerColumn("humidity_count")
+		PressureCountColumn             = postgres.IntegerColumn("pressure_count")
+		AccelerationXCountColumn        = postgres.IntegerColumn("acceleration_x_count")
+		AccelerationYCountColumn        = postgres.IntegerColumn("acceleration_y_count")
+		AccelerationZCountColumn        = postgres.IntegerColumn("acceleration_z_count")
+		BatteryVoltageCountColumn       = postgres.IntegerColumn("battery_voltage_count")
+		RssiCountColumn                 = postgres.IntegerColumn("rssi_count")
+		allColumns                      = postgres.ColumnList{IDColumn, DeviceIDColumn, CreatedAtColumn, TemperatureColumn, HumidityColumn, PressureColumn, AccelerationXColumn, AccelerationYColumn, AccelerationZColumn, BatteryVoltageColumn, TxPowerColumn, MovementCounterColumn, MeasurementSequenceNumberColumn, RssiColumn, GatewayColumn, SampleCountColumn, TemperatureCountColumn, HumidityCountColumn, PressureCountColumn, AccelerationXCountColumn, AccelerationYCountColumn, AccelerationZCountColumn, BatteryVoltageCountColumn, RssiCountColumn}
+		mutableColumns                  = postgres.ColumnList{DeviceIDColumn, CreatedAtColumn, TemperatureColumn, HumidityColumn, PressureColumn, AccelerationXColumn, AccelerationYColumn, AccelerationZColumn, BatteryVoltageColumn, TxPowerColumn, MovementCounterColumn, MeasurementSequenceNumberColumn, RssiColumn, GatewayColumn, SampleCountColumn, TemperatureCountColumn, HumidityCountColumn, PressureCountColumn, AccelerationXCountColumn, AccelerationYCountColumn, AccelerationZCountColumn, BatteryVoltageCountColumn, RssiCountColumn}
+		defaultColumns                  = postgres.ColumnList{IDColumn, SampleCountColumn}
 	)
 
 	return measurementTable{
@@ -109,6 +129,16 @@ func newMeasurementTableImpl(schemaName, tableName, alias string) measurementTab
 		MovementCounter:           MovementCounterColumn,
 		MeasurementSequenceNumber: MeasurementSequenceNumberColumn,
 		Rssi:                      RssiColumn,
+		Gateway:                   GatewayColumn,
+		SampleCount:               SampleCountColumn,
+		TemperatureCount:          TemperatureCountColumn,
+		HumidityCount:             HumidityCountColumn,
+		PressureCount:             PressureCountColumn,
+		AccelerationXCount:        AccelerationXCountColumn,
+		AccelerationYCount:        AccelerationYCountColumn,
+		AccelerationZCount:        AccelerationZCountColumn,
+		BatteryVoltageCount:       BatteryVoltageCountColumn,
+		RssiCount:                 RssiCountColumn,
 
 		AllColumns:     allColumns,
 		MutableColumns: mutableColumns,
@@ -10,6 +10,14 @@ package table
 // UseSchema sets a new schema name for all generated table SQL builder types. It is recommended to invoke
 // this method only once at the beginning of the program.
 func UseSchema(schema string) {
+	Alert = Alert.FromSchema(schema)
+	APIToken = APIToken.FromSchema(schema)
 	Device = Device.FromSchema(schema)
 	Measurement = Measurement.FromSchema(schema)
+	MeasurementDaily = MeasurementDaily.FromSchema(schema)
+	MeasurementHourly = MeasurementHourly.FromSchema(schema)
+	QuarantinedMeasurement = QuarantinedMeasurement.FromSchema(schema)
+	RejectedMeasurement = RejectedMeasurement.FromSchema(schema)
+	SensorGap = SensorGap.FromSchema(schema)
+	StationEvent = StationEvent.FromSchema(schema)
 }
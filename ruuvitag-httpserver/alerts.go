@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Alert rules. Every stored measurement is checked against the rules of its device. A rule fires once
+// its condition has held for the configured duration and resolves once the value is back past the
+// threshold by the hysteresis. Alerts are kept in the alert table and sent to the notifiers of the rule.
+// Rules are checked by a single worker, in the order the measurements were stored.
+
+const (
+	AlertStatusFiring   = "firing"
+	AlertStatusResolved = "resolved"
+
+	alertQueueSize = 256
+)
+
+// AlertRule is one condition on a field of a device. Exactly one of Above, Below and MaxRatePerMinute is set.
+type AlertRule struct {
+	Name string `yaml:"name"`
+	// Devices by MAC or label, every device when empty
+	Devices []string `yaml:"devices"`
+	// Field is one of the validation fields, in the units of the measurement API
+	Field string   `yaml:"field"`
+	Above *float64 `yaml:"above"`
+	Below *float64 `yaml:"below"`
+	// MaxRatePerMinute fires when the field changes faster from one reading to the next
+	MaxRatePerMinute *float64 `yaml:"maxRatePerMinute"`
+	// For is how long the condition has to hold before the rule fires
+	For time.Duration `yaml:"for"`
+	// Hysteresis is how far back past the threshold the value has to get to resolve the alert
+	Hysteresis float64 `yaml:"hysteresis"`
+	// Notify names the notifiers of the rule, all notifiers when empty
+	Notify []string `yaml:"notify"`
+}
+
+type AlertsConfig struct {
+	Rules     []AlertRule      `yaml:"rules"`
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+}
+
+type AlertJson struct {
+	ID         int32      `json:"id"`
+	Rule       string     `json:"rule"`
+	MAC        string     `json:"mac"`
+	Label      string     `json:"label"`
+	Field      string     `json:"field"`
+	Status     string     `json:"status"`
+	Value      float64    `json:"value"`
+	Threshold  float64    `json:"threshold"`
+	StartedAt  time.Time  `json:"startedAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type alertKey struct {
+	rule     string
+	deviceID int32
+}
+
+// alertState is what the worker knows about a rule of a device
+type alertState struct {
+	// breachingSince is when the condition started to hold, nil when it does not
+	breachingSince *time.Time
+	firing         *model.Alert
+	// previous is the previous reading, for the rate of change
+	previous *MeasurementJson
+}
+
+var (
+	alertQueue  = make(chan storedMeasurement, alertQueueSize)
+	alertStates = map[alertKey]*alertState{}
+)
+
+func checkAlertsConfig(c AlertsConfig) error {
+	notifiers := map[string]bool{}
+	for _, n := range c.Notifiers {
+		if err := checkNotifierConfig(n); err != nil {
+			return err
+		}
+		if notifiers[n.Name] {
+			return fmt.Errorf("notifier %s is configured twice", n.Name)
+		}
+		notifiers[n.Name] = true
+	}
+
+	rules := map[string]bool{}
+	for _, rule := range c.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("alert rule without a name")
+		}
+		if rules[rule.Name] {
+			return fmt.Errorf("alert rule %s is configured twice", rule.Name)
+		}
+		rules[rule.Name] = true
+
+		if _, ok := validationFields[rule.Field]; !ok {
+			return fmt.Errorf("alert rule %s: unknown field %s", rule.Name, rule.Field)
+		}
+		conditions := 0
+		for _, limit := range []*float64{rule.Above, rule.Below, rule.MaxRatePerMinute} {
+			if limit != nil {
+				conditions++
+			}
+		}
+		if conditions != 1 {
+			return fmt.Errorf("alert rule %s needs exactly one of above, below and maxRatePerMinute", rule.Name)
+		}
+		if rule.For < 0 || rule.Hysteresis < 0 {
+			return fmt.Errorf("alert rule %s: for and hysteresis must not be negative", rule.Name)
+		}
+		for _, name := range rule.Notify {
+			if !notifiers[name] {
+				return fmt.Errorf("alert rule %s: unknown notifier %s", rule.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// appliesTo is whether the rule checks the device
+func (rule AlertRule) appliesTo(device model.Device) bool {
+	if len(rule.Devices) == 0 {
+		return true
+	}
+	for _, key := range rule.Devices {
+		if strings.EqualFold(key, device.Mac) || key == device.Label {
+			return true
+		}
+	}
+	return false
+}
+
+// threshold returns the limit of the rule
+func (rule AlertRule) threshold() float64 {
+	switch {
+	case rule.Above != nil:
+		return *rule.Above
+	case rule.Below != nil:
+		return *rule.Below
+	default:
+		return *rule.MaxRatePerMinute
+	}
+}
+
+// alertRules returns the configured rules and the built in ones
+func alertRules() []AlertRule {
+	rules := config.Alerts.Rules
+	if config.Battery.Alert {
+		rules = append(slices.Clip(rules), batteryRule())
+	}
+	return rules
+}
+
+// checkAlerts queues the stored measurement for the alert worker
+func checkAlerts(device model.Device, m *MeasurementJson) {
+	if len(alertRules()) == 0 {
+		return
+	}
+	select {
+	case alertQueue <- storedMeasurement{device: device, m: m}:
+	default:
+		log.Error().Msgf("Alert queue is full, not checking measurement of %s", m.MAC)
+	}
+}
+
+// runAlerts checks the queued measurements against the rules
+func runAlerts() {
+	if err := loadFiringAlerts(); err != nil {
+		log.Error().Err(err).Msg("Failed to load firing alerts, they fire again")
+	}
+	for item := range alertQueue {
+		for _, rule := range alertRules() {
+			if !rule.appliesTo(item.device) {
+				continue
+			}
+			m := item.m
+			if rule.Name == batteryAlertRule {
+				m = smoothedBatteryMeasurement(item.device, item.m)
+			}
+			evaluateRule(rule, item.device, m)
+		}
+	}
+}
+
+// loadFiringAlerts takes over the alerts that were firing before a restart
+func loadFiringAlerts() error {
+	var firing []model.Alert
+	stmt := SELECT(Alert.AllColumns).FROM(Alert).WHERE(Alert.Status.EQ(String(AlertStatusFiring)))
+	if err := stmt.Query(db, &firing); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		return err
+	}
+	for i := range firing {
+		alertStates[alertKey{rule: firing[i].Rule, deviceID: firing[i].DeviceID}] = &alertState{firing: &firing[i]}
+	}
+	return nil
+}
+
+// evaluateRule updates the state of the rule for the device with the measurement, firing or resolving it
+func evaluateRule(rule AlertRule, device model.Device, m *MeasurementJson) {
+	value := validationFields[rule.Field](m)
+	if value == nil {
+		return
+	}
+	at := measurementTime(m)
+
+	key := alertKey{rule: rule.Name, deviceID: device.ID}
+	state, ok := alertStates[key]
+	if !ok {
+		state = &alertState{}
+		alertStates[key] = state
+	}
+
+	threshold := rule.threshold()
+	observed := *value
+	var breach, cleared bool
+	switch {
+	case rule.Above != nil:
+		breach = observed > threshold
+		cleared = observed <= threshold-rule.Hysteresis
+	case rule.Below != nil:
+		breach = observed < threshold
+		cleared = observed >= threshold+rule.Hysteresis
+	default:
+		previous := state.previous
+		current := *m
+		current.Timestamp = &at
+		state.previous = &current
+		if previous == nil {
+			return
+		}
+		rate, ok := ratePerMinute(previous, &current, validationFields[rule.Field])
+		if !ok {
+			return
+		}
+		observed = rate
+		breach = rate > threshold
+		cleared = rate <= threshold-rule.Hysteresis
+	}
+
+	if state.firing != nil {
+		if cleared {
+			resolveAlert(rule, device, state, observed, at)
+		}
+		return
+	}
+	if !breach {
+		state.breachingSince = nil
+		return
+	}
+	if state.breachingSince == nil {
+		state.breachingSince = &at
+	}
+	if at.Sub(*state.breachingSince) >= rule.For {
+		fireAlert(rule, device, state, observed, *state.breachingSince)
+		state.breachingSince = nil
+	}
+}
+
+func fireAlert(rule AlertRule, device model.Device, state *alertState, value float64, startedAt time.Time) {
+	alert := model.Alert{
+		Rule:      rule.Name,
+		DeviceID:  device.ID,
+		Field:     rule.Field,
+		Status:    AlertStatusFiring,
+		Value:     value,
+		Threshold: rule.threshold(),
+		StartedAt: startedAt,
+	}
+	insertStmt := Alert.INSERT(Alert.MutableColumns).MODEL(alert).RETURNING(Alert.AllColumns)
+	if err := insertStmt.Query(db, &alert); err != nil {
+		// Notify anyway, the alert matters more than its record
+		log.Error().Err(err).Msgf("Failed to store alert %s of %s", rule.Name, device.Mac)
+	}
+	state.firing = &alert
+	alertCounter.WithLabelValues(rule.Name, AlertStatusFiring).Inc()
+	log.Warn().Msgf("Alert %s is firing for %s: %s %g", rule.Name, device.Label, rule.Field, value)
+
+	notifyAlert(rule, newNotification(rule, device, alert))
+}
+
+func resolveAlert(rule AlertRule, device model.Device, state *alertState, value float64, resolvedAt time.Time) {
+	alert := *state.firing
+	alert.Status = AlertStatusResolved
+	alert.Value = value
+	alert.ResolvedAt = &resolvedAt
+	if alert.ID != 0 {
+		updateStmt := Alert.UPDATE(Alert.Status, Alert.ResolvedAt).
+			SET(String(AlertStatusResolved), TimestampzT(resolvedAt)).
+			WHERE(Alert.ID.EQ(Int32(alert.ID)))
+		if _, err := updateStmt.Exec(db); err != nil {
+			log.Error().Err(err).Msgf("Failed to resolve alert %d", alert.ID)
+		}
+	}
+	state.firing = nil
+	alertCounter.WithLabelValues(rule.Name, AlertStatusResolved).Inc()
+	log.Info().Msgf("Alert %s of %s resolved: %s %g", rule.Name, device.Label, rule.Field, value)
+
+	notifyAlert(rule, newNotification(rule, device, alert))
+}
+
+func toAlertJson(alert model.Alert, device model.Device) AlertJson {
+	return AlertJson{
+		ID:         alert.ID,
+		Rule:       alert.Rule,
+		MAC:        device.Mac,
+		Label:      device.Label,
+		Field:      alert.Field,
+		Status:     alert.Status,
+		Value:      alert.Value,
+		Threshold:  alert.Threshold,
+		StartedAt:  alert.StartedAt,
+		ResolvedAt: alert.ResolvedAt,
+	}
+}
+
+// getAlerts lists the latest alerts, optionally only those with the given status
+func getAlerts(c echo.Context) error {
+	condition := Bool(true)
+	if status := c.QueryParam("status"); status != "" {
+		condition = Alert.Status.EQ(String(status))
+	}
+
+	var alerts []struct {
+		model.Alert
+		Device model.Device
+	}
+	stmt := SELECT(Alert.AllColumns, Device.AllColumns).
+		FROM(Alert.INNER_JOIN(Device, Device.ID.EQ(Alert.DeviceID))).
+		WHERE(condition).
+		ORDER_BY(Alert.StartedAt.DESC()).
+		LIMIT(100)
+	if err := stmt.Query(db, &alerts); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		log.Error().Err(err).Msg("Failed to select alerts")
+		return echo.NewHTTPError(500, "Failed to read alerts")
+	}
+
+	result := []AlertJson{}
+	for _, a := range alerts {
+		result = append(result, toAlertJson(a.Alert, a.Device))
+	}
+	return c.JSON(200, result)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+const (
+	alertNone    = ""
+	alertPending = "pending"
+	alertFiring  = "firing"
+)
+
+// alertStep is a reading minutes after the start and the state of the rule after it. A nil value is a
+// reading without the field.
+type alertStep struct {
+	minutes float64
+	value   *float64
+	want    string
+}
+
+func TestEvaluateRule(t *testing.T) {
+	useDatabaseDown(t)
+	previousConfig := config
+	t.Cleanup(func() {
+		config = previousConfig
+		alertStates = map[alertKey]*alertState{}
+	})
+	config = defaultConfig()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	device := model.Device{ID: 1, Mac: "aa:bb:cc:dd:ee:01", Label: "freezer", Status: DeviceStatusActive}
+	tests := []struct {
+		name  string
+		rule  AlertRule
+		steps []alertStep
+	}{
+		{
+			name: "above fires right away",
+			rule: AlertRule{Field: "temperature", Above: limit(30)},
+			steps: []alertStep{
+				{0, float(29), alertNone},
+				{1, float(30), alertNone},
+				{2, float(30.5), alertFiring},
+			},
+		},
+		{
+			name: "pending until for has passed",
+			rule: AlertRule{Field: "temperature", Above: limit(30), For: 5 * time.Minute},
+			steps: []alertStep{
+				{0, float(31), alertPending},
+				{2, float(32), alertPending},
+				{4.9, float(33), alertPending},
+				{5, float(33), alertFiring},
+			},
+		},
+		{
+			name: "for starts again after the condition stopped holding",
+			rule: AlertRule{Field: "temperature", Above: limit(30), For: 5 * time.Minute},
+			steps: []alertStep{
+				{0, float(31), alertPending},
+				{2, float(29), alertNone},
+				{4, float(31), alertPending},
+				{8, float(31), alertPending},
+				{9, float(31), alertFiring},
+			},
+		},
+		{
+			name: "above resolves only past the hysteresis",
+			rule: AlertRule{Field: "temperature", Above: limit(30), Hysteresis: 2},
+			steps: []alertStep{
+				{0, float(31), alertFiring},
+				{1, float(29), alertFiring},
+				{2, float(28.5), alertFiring},
+				{3, float(28), alertNone},
+			},
+		},
+		{
+			name: "below resolves only past the hysteresis",
+			rule: AlertRule{Field: "temperature", Below: limit(0), Hysteresis: 1},
+			steps: []alertStep{
+				{0, float(2), alertNone},
+				{1, float(0), alertNone},
+				{2, float(-0.5), alertFiring},
+				{3, float(0.5), alertFiring},
+				{4, float(1), alertNone},
+			},
+		},
+		{
+			name: "fires again after resolving",
+			rule: AlertRule{Field: "temperature", Above: limit(30), Hysteresis: 1},
+			steps: []alertStep{
+				{0, float(31), alertFiring},
+				{1, float(29), alertNone},
+				{2, float(31), alertFiring},
+			},
+		},
+		{
+			name: "readings without the field are ignored",
+			rule: AlertRule{Field: "temperature", Above: limit(30), Hysteresis: 1},
+			steps: []alertStep{
+				{0, float(31), alertFiring},
+				{1, nil, alertFiring},
+				{2, float(28), alertNone},
+			},
+		},
+		{
+			name: "rate",
+			rule: AlertRule{Field: "temperature", MaxRatePerMinute: limit(1)},
+			steps: []alertStep{
+				{0, float(20), alertNone},
+				{1, float(21), alertNone},
+				{2, float(25), alertFiring},
+				{3, float(25.5), alertNone},
+			},
+		},
+		{
+			name: "rate resolves only past the hysteresis",
+			rule: AlertRule{Field: "temperature", MaxRatePerMinute: limit(2), Hysteresis: 1},
+			steps: []alertStep{
+				{0, float(20), alertNone},
+				{1, float(23), alertFiring},
+				{2, float(24.5), alertFiring},
+				{3, float(25.5), alertNone},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alertStates = map[alertKey]*alertState{}
+			tt.rule.Name = "test"
+			for i, step := range tt.steps {
+				at := start.Add(time.Duration(step.minutes * float64(time.Minute)))
+				evaluateRule(tt.rule, device, &MeasurementJson{MAC: device.Mac, Temperature: step.value, Timestamp: &at})
+
+				got := alertNone
+				if state := alertStates[alertKey{rule: tt.rule.Name, deviceID: device.ID}]; state != nil {
+					switch {
+					case state.firing != nil:
+						got = alertFiring
+					case state.breachingSince != nil:
+						got = alertPending
+					}
+				}
+				if got != step.want {
+					t.Fatalf("step %d: state = %q, want %q", i, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSmtpMessageSubject(t *testing.T) {
+	s := smtpNotifier{from: "ruuvi@example.com", to: []string{"me@example.com"}}
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{name: "ascii", title: "Freezer is firing", want: "Subject: Freezer is firing\r\n"},
+		{name: "non-ascii", title: "Sauna über 90", want: "Subject: =?utf-8?q?Sauna_=C3=BCber_90?=\r\n"},
+		{name: "line break", title: "Sauna\r\nBcc: other@example.com", want: "Subject: =?utf-8?q?Sauna=0D=0ABcc:_other@example.com?=\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := s.message(Notification{Title: tt.title, Message: "body"}, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+			headers, _, _ := strings.Cut(message, "\r\n\r\n")
+			if !strings.Contains(headers+"\r\n", tt.want) {
+				t.Errorf("headers = %q, want %q", headers, tt.want)
+			}
+			if strings.Count(headers, "\r\n") != 4 {
+				t.Errorf("headers = %q, want 5 lines", headers)
+			}
+		})
+	}
+}
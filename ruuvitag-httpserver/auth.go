@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// API tokens for the ingestion and device management endpoints. Requests carry the token either as
+// a bearer token or, for microcontrollers that cannot do TLS, sign the request with HMAC-SHA256:
+//
+//	X-Token-Id:  id of the token
+//	X-Timestamp: Unix time in seconds
+//	X-Signature: hex(HMAC-SHA256(signing key, timestamp + "\n" + method + "\n" + path and query + "\n" + body))
+//
+// The signing key is derived from the token with the server secret TOKEN_SIGNING_SECRET in .env, so it
+// cannot be derived from the database alone. It is printed once when the token is created, so a device that
+// signs its requests never needs the token itself. Changing the server secret invalidates all signing keys.
+// A signature is accepted only once, so a captured request cannot be replayed within the timestamp window.
+//
+// Only the InfluxDB v1 /write route also takes the token as the p query parameter, for clients that cannot
+// send headers. Its URI is logged without the query.
+//
+// Tokens are authenticated from a cache, so that measurements are still accepted and spooled while Postgres
+// is unavailable. A trigger on api_token notifies api_token_changed, see migrations/0016_api_token_notify.sql,
+// and syncDevices reloads the cache on it and every reload interval.
+
+const (
+	TokenScopeIngest = "ingest"
+	TokenScopeAdmin  = "admin"
+
+	headerTokenID   = "X-Token-Id"
+	headerTimestamp = "X-Timestamp"
+	headerSignature = "X-Signature"
+
+	// maxSignatureAge is how far the timestamp of a signed request may be from the server time
+	maxSignatureAge = 5 * time.Minute
+
+	identityContextKey = "identity"
+	tokenPrefix        = "rvt_"
+
+	// queryTokenPath is the only route that takes the token as a query parameter
+	queryTokenPath = "/write"
+
+	tokenChannel = "api_token_changed"
+	// tokenUsedInterval is how often the last use of a token is recorded at most
+	tokenUsedInterval = time.Minute
+)
+
+var (
+	errInvalidToken     = errors.New("invalid or revoked token")
+	errInvalidSignature = errors.New("invalid signature")
+
+	// authEnabled requires a token on the protected endpoints, turned off only with AUTH_ENABLED=false
+	authEnabled = true
+
+	// usedSignatures are the signatures accepted within the timestamp window, by when they can be forgotten
+	usedSignatures     = map[string]time.Time{}
+	usedSignaturesLock sync.Mutex
+
+	// tokens caches the tokens that are not revoked by ID, guarded by tokensLock
+	tokens       = map[int32]model.APIToken{}
+	tokensLoaded = false
+	tokensLock   sync.RWMutex
+)
+
+func configureAuth() {
+	authEnabled = envFile["AUTH_ENABLED"] != "false"
+	if !authEnabled {
+		log.Warn().Msg("AUTH_ENABLED is false, ingestion and device endpoints accept requests without a token")
+	}
+	if envFile["TOKEN_SIGNING_SECRET"] == "" {
+		log.Warn().Msg("TOKEN_SIGNING_SECRET is not set, signed requests are rejected")
+	}
+	// Tokens are loaded lazily again on the next request if this fails
+	if err := loadTokens(); err != nil {
+		log.Error().Err(err).Msg("Failed to load tokens on startup")
+		return
+	}
+	tokensLock.RLock()
+	count := len(tokens)
+	tokensLock.RUnlock()
+	if authEnabled && count == 0 {
+		log.Warn().Msg("There are no tokens, ingestion and device endpoints refuse every request. " +
+			"Create one with \"ruuvitag-httpserver token create <name>\" or set AUTH_ENABLED=false.")
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// signingKey derives the signing key of a token from its hash and the server secret, empty without a secret
+func signingKey(tokenHash string) string {
+	secret := envFile["TOKEN_SIGNING_SECRET"]
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tokenHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return tokenPrefix + hex.EncodeToString(secret), nil
+}
+
+// tokenAllows tells whether a token of the given scope may be used for the required scope.
+// Admin tokens may also ingest.
+func tokenAllows(token model.APIToken, scope string) bool {
+	return token.Scope == scope || token.Scope == TokenScopeAdmin
+}
+
+// requireScope is middleware that authenticates the request with a token of the given scope
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !authEnabled {
+				return next(c)
+			}
+
+			token, err := authenticate(c)
+			if errors.Is(err, errInvalidToken) || errors.Is(err, errInvalidSignature) {
+				log.Warn().Err(err).Msgf("Unauthorized request to %s from %s", c.Path(), c.RealIP())
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return echo.NewHTTPError(401, err.Error())
+			}
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to authenticate request")
+				return echo.NewHTTPError(500, "Failed to authenticate")
+			}
+			if !tokenAllows(token, scope) {
+				return echo.NewHTTPError(403, fmt.Sprintf("Token %s is not allowed to %s", token.Name, scope))
+			}
+
+			c.Set(identityContextKey, token.Name)
+			return next(c)
+		}
+	}
+}
+
+// requestIdentity returns the name of the reader or gateway whose token authenticated the request
+func requestIdentity(c echo.Context) *string {
+	if name, ok := c.Get(identityContextKey).(string); ok {
+		return &name
+	}
+	return nil
+}
+
+func authenticate(c echo.Context) (model.APIToken, error) {
+	request := c.Request()
+
+	if signature := request.Header.Get(headerSignature); signature != "" {
+		return authenticateSignature(c, signature)
+	}
+
+	token := requestToken(c)
+	if token == "" {
+		return model.APIToken{}, fmt.Errorf("%w: no token given", errInvalidToken)
+	}
+	hash := hashToken(token)
+	found, err := findToken(func(t model.APIToken) bool { return t.TokenHash == hash })
+	if err != nil {
+		return found, err
+	}
+	markTokenUsed(found)
+	return found, nil
+}
+
+// requestToken returns the bearer token. InfluxDB clients send it as "Token <token>", as the password of
+// basic auth or, on /write only, as the p query parameter.
+func requestToken(c echo.Context) string {
+	request := c.Request()
+	authorization := request.Header.Get(echo.HeaderAuthorization)
+	for _, scheme := range []string{"Bearer ", "Token "} {
+		if token, found := strings.CutPrefix(authorization, scheme); found {
+			return strings.TrimSpace(token)
+		}
+	}
+	if _, password, ok := request.BasicAuth(); ok {
+		return password
+	}
+	if c.Path() == queryTokenPath {
+		return c.QueryParam("p")
+	}
+	return ""
+}
+
+func authenticateSignature(c echo.Context, signature string) (model.APIToken, error) {
+	request := c.Request()
+
+	id, err := strconv.ParseInt(request.Header.Get(headerTokenID), 10, 32)
+	if err != nil {
+		return model.APIToken{}, fmt.Errorf("%w: invalid %s", errInvalidSignature, headerTokenID)
+	}
+	timestamp := request.Header.Get(headerTimestamp)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return model.APIToken{}, fmt.Errorf("%w: invalid %s", errInvalidSignature, headerTimestamp)
+	}
+	if age := time.Since(time.Unix(seconds, 0)); math.Abs(float64(age)) > float64(maxSignatureAge) {
+		return model.APIToken{}, fmt.Errorf("%w: timestamp is off by %s", errInvalidSignature, age.Round(time.Second))
+	}
+
+	// The body is read for the signature and handed on to the handler
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return model.APIToken{}, err
+	}
+	request.Body = io.NopCloser(bytes.NewReader(body))
+
+	token, err := findToken(func(t model.APIToken) bool { return t.ID == int32(id) })
+	if err != nil {
+		return token, err
+	}
+	key := signingKey(token.TokenHash)
+	if key == "" {
+		return model.APIToken{}, fmt.Errorf("%w: signing is not configured", errInvalidSignature)
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, request.Method, request.URL.RequestURI())
+	mac.Write(body)
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac.Sum(nil), given) {
+		return model.APIToken{}, errInvalidSignature
+	}
+	if !useSignature(signature, time.Unix(seconds, 0)) {
+		return model.APIToken{}, fmt.Errorf("%w: request was already used", errInvalidSignature)
+	}
+	markTokenUsed(token)
+	return token, nil
+}
+
+// useSignature records the signature and tells whether it was not used before. Signatures are kept until
+// their timestamp is out of the window.
+func useSignature(signature string, timestamp time.Time) bool {
+	usedSignaturesLock.Lock()
+	defer usedSignaturesLock.Unlock()
+
+	now := time.Now()
+	for used, expires := range usedSignatures {
+		if now.After(expires) {
+			delete(usedSignatures, used)
+		}
+	}
+	signature = strings.ToLower(signature)
+	if _, used := usedSignatures[signature]; used {
+		return false
+	}
+	usedSignatures[signature] = timestamp.Add(maxSignatureAge)
+	return true
+}
+
+// loadTokens fills the token cache from the database once. syncDevices keeps it current after that.
+func loadTokens() error {
+	tokensLock.RLock()
+	loaded := tokensLoaded
+	tokensLock.RUnlock()
+
+	if loaded {
+		return nil
+	}
+	return reloadTokens()
+}
+
+// reloadTokens replaces the token cache with the tokens that are not revoked
+func reloadTokens() error {
+	var active []model.APIToken
+	selectStmt := SELECT(APIToken.AllColumns).FROM(APIToken).WHERE(APIToken.RevokedAt.IS_NULL())
+	if err := selectStmt.Query(db, &active); err != nil {
+		log.Error().Err(err).Msg("Failed to select tokens")
+		return err
+	}
+
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+	previous := tokens
+	tokens = map[int32]model.APIToken{}
+	for _, token := range active {
+		// A use that is not recorded yet is kept
+		if cached, ok := previous[token.ID]; ok && cached.LastUsedAt != nil &&
+			(token.LastUsedAt == nil || cached.LastUsedAt.After(*token.LastUsedAt)) {
+			token.LastUsedAt = cached.LastUsedAt
+		}
+		tokens[token.ID] = token
+	}
+	tokensLoaded = true
+	return nil
+}
+
+// findToken finds the token that is not revoked in the cache
+func findToken(match func(token model.APIToken) bool) (model.APIToken, error) {
+	if err := loadTokens(); err != nil {
+		return model.APIToken{}, err
+	}
+
+	tokensLock.RLock()
+	defer tokensLock.RUnlock()
+	for _, token := range tokens {
+		if match(token) {
+			return token, nil
+		}
+	}
+	return model.APIToken{}, errInvalidToken
+}
+
+// markTokenUsed records the use of an authenticated token in the background, at most every
+// tokenUsedInterval. A failure to record it does not fail the request.
+func markTokenUsed(token model.APIToken) {
+	now := time.Now()
+	tokensLock.Lock()
+	cached, ok := tokens[token.ID]
+	if !ok || (cached.LastUsedAt != nil && now.Sub(*cached.LastUsedAt) < tokenUsedInterval) {
+		tokensLock.Unlock()
+		return
+	}
+	cached.LastUsedAt = &now
+	tokens[token.ID] = cached
+	tokensLock.Unlock()
+
+	go func(db qrm.DB) {
+		updateStmt := APIToken.UPDATE(APIToken.LastUsedAt).
+			SET(TimestampzT(now)).
+			WHERE(APIToken.ID.EQ(Int32(token.ID)))
+		if _, err := updateStmt.Exec(db); err != nil {
+			log.Warn().Err(err).Msgf("Failed to record the use of token %s", token.Name)
+		}
+	}(db)
+}
+
+// createToken stores a new token and returns it in plain text, it cannot be read back later
+func createToken(name string, scope string) (model.APIToken, string, error) {
+	if scope != TokenScopeIngest && scope != TokenScopeAdmin {
+		return model.APIToken{}, "", fmt.Errorf("scope must be %s or %s", TokenScopeIngest, TokenScopeAdmin)
+	}
+	plain, err := generateToken()
+	if err != nil {
+		return model.APIToken{}, "", err
+	}
+
+	token := model.APIToken{Name: name, Scope: scope, TokenHash: hashToken(plain)}
+	insertStmt := APIToken.INSERT(APIToken.Name, APIToken.Scope, APIToken.TokenHash).
+		MODEL(token).
+		RETURNING(APIToken.AllColumns)
+	if err := insertStmt.Query(db, &token); err != nil {
+		return token, "", err
+	}
+	return token, plain, nil
+}
+
+func listTokens() ([]model.APIToken, error) {
+	tokens := []model.APIToken{}
+	selectStmt := SELECT(APIToken.AllColumns).FROM(APIToken).ORDER_BY(APIToken.ID.ASC())
+	err := selectStmt.Query(db, &tokens)
+	return tokens, err
+}
+
+func revokeToken(name string) error {
+	updateStmt := APIToken.UPDATE(APIToken.RevokedAt).
+		SET(NOW()).
+		WHERE(APIToken.Name.EQ(String(name)).AND(APIToken.RevokedAt.IS_NULL()))
+	result, err := updateStmt.Exec(db)
+	if err != nil {
+		return err
+	}
+	if revoked, _ := result.RowsAffected(); revoked == 0 {
+		return fmt.Errorf("no active token named %s", name)
+	}
+	return nil
+}
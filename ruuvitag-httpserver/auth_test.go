@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/labstack/echo/v4"
+)
+
+// connectedMqttClient is an MQTT client that reports an open connection and must not be used otherwise
+type connectedMqttClient struct {
+	mqtt.Client
+}
+
+func (connectedMqttClient) IsConnectionOpen() bool { return true }
+
+// useDatabaseDown makes every query fail as if Postgres was down
+func useDatabaseDown(t *testing.T) {
+	t.Helper()
+	previousDb := db
+	// Nothing listens on port 1, connecting fails right away
+	down, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = down
+	t.Cleanup(func() {
+		db = previousDb
+		down.Close()
+	})
+}
+
+// setupDatabaseDown authenticates from a loaded token cache and stores into a spool while every query fails
+func setupDatabaseDown(t *testing.T, token model.APIToken, device model.Device) {
+	t.Helper()
+	previousMqttClient, previousSpool, previousConfig := mqttClient, spool, config
+	previousAuthEnabled, previousTokens, previousTokensLoaded := authEnabled, tokens, tokensLoaded
+	previousDevices, previousDevicesLoaded := devices, devicesLoaded
+	t.Cleanup(func() {
+		mqttClient, spool, config = previousMqttClient, previousSpool, previousConfig
+		authEnabled, tokens, tokensLoaded = previousAuthEnabled, previousTokens, previousTokensLoaded
+		devices, devicesLoaded = previousDevices, previousDevicesLoaded
+		previousReadings = map[string]*MeasurementJson{}
+	})
+
+	useDatabaseDown(t)
+	mqttClient = connectedMqttClient{}
+	spool = openTestSpool(t, SpoolConfig{Dir: t.TempDir(), MaxBytes: defaultSpoolMaxBytes})
+	config = defaultConfig()
+	previousReadings = map[string]*MeasurementJson{}
+
+	authEnabled = true
+	tokens = map[int32]model.APIToken{token.ID: token}
+	tokensLoaded = true
+	devices = map[string]model.Device{device.Mac: device}
+	devicesLoaded = true
+}
+
+func TestAuthenticatedIngestIsSpooledWhileDatabaseIsDown(t *testing.T) {
+	const plain = "rvt_0123456789abcdef"
+	token := model.APIToken{ID: 1, Name: "reader-1", Scope: TokenScopeIngest, TokenHash: hashToken(plain)}
+	device := model.Device{ID: 1, Mac: "aa:bb:cc:dd:ee:01", Label: "sauna", Status: DeviceStatusActive}
+	setupDatabaseDown(t, token, device)
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantDepth     int
+	}{
+		{name: "valid token", authorization: "Bearer " + plain, wantStatus: 200, wantDepth: 1},
+		{name: "unknown token", authorization: "Bearer rvt_unknown", wantStatus: 401, wantDepth: 1},
+		{name: "no token", wantStatus: 401, wantDepth: 1},
+		{name: "valid token again", authorization: "Token " + plain, wantStatus: 200, wantDepth: 2},
+	}
+	e := echo.New()
+	e.POST("/measurements", postMeasurement, requireScope(TokenScopeIngest))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/measurements",
+				strings.NewReader(`{"mac":"aa:bb:cc:dd:ee:01","temp":21.5}`))
+			request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if tt.authorization != "" {
+				request.Header.Set(echo.HeaderAuthorization, tt.authorization)
+			}
+			response := httptest.NewRecorder()
+			e.ServeHTTP(response, request)
+
+			if response.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", response.Code, tt.wantStatus, response.Body)
+			}
+			if depth := spool.depth(); depth != tt.wantDepth {
+				t.Errorf("spool depth = %d, want %d", depth, tt.wantDepth)
+			}
+		})
+	}
+
+	m, err := spool.peek()
+	if err != nil || m == nil {
+		t.Fatalf("peek() = %v, %v, want the spooled measurement", m, err)
+	}
+	if m.Gateway == nil || *m.Gateway != token.Name {
+		t.Errorf("spooled measurement has gateway %v, want %s", m.Gateway, token.Name)
+	}
+}
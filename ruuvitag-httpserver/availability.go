@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+	"github.com/rs/zerolog/log"
+)
+
+// MQTT availability of the server (birth and last will) and of each tag
+
+const (
+	serverAvailabilityTopic = "ruuvitag-httpserver/availability"
+	payloadOnline           = "online"
+	payloadOffline          = "offline"
+
+	defaultOfflineAfter       = 15 * time.Minute
+	availabilityCheckInterval = 30 * time.Second
+)
+
+type deviceAvailability struct {
+	device   model.Device
+	lastSeen time.Time
+	// state is the last published availability, empty when nothing has been published yet
+	state string
+	// returnedAt is the first reading after the device was offline or the server started, until the
+	// watchdog has closed its gap
+	returnedAt *time.Time
+}
+
+var (
+	// offlineAfter is how long a tag may stay silent before it is reported offline
+	offlineAfter = defaultOfflineAfter
+
+	// availabilities by lowercase MAC, guarded by availabilityLock
+	availabilities   = map[string]*deviceAvailability{}
+	availabilityLock sync.Mutex
+	// lastReadings are the newest stored readings by device ID from before the server started, guarded by
+	// availabilityLock
+	lastReadings = map[int32]time.Time{}
+)
+
+func configureAvailability() {
+	offlineAfter = config.Stale.After
+	if value := envFile["SENSOR_OFFLINE_AFTER"]; value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			log.Error().Err(err).Msgf("Invalid SENSOR_OFFLINE_AFTER %s, using %s", value, defaultOfflineAfter)
+			return
+		}
+		offlineAfter = duration
+	}
+}
+
+func deviceAvailabilityTopic(device model.Device) string {
+	return stateTopic(device) + "/availability"
+}
+
+// publishServerOnline is the birth message, the last will publishes offline to the same topic
+func publishServerOnline(client mqtt.Client) {
+	token := client.Publish(serverAvailabilityTopic, 1, true, payloadOnline)
+	if token.WaitTimeout(2*time.Second) && token.Error() == nil {
+		log.Info().Msg("Published server availability")
+	} else {
+		log.Error().Err(token.Error()).Msg("Failed to publish server availability")
+	}
+}
+
+// loadLastReadings takes the newest stored reading of each device, so that a device that was silent before a
+// restart is reported offline, and its gap opened, from that reading on
+func loadLastReadings() error {
+	var newest []struct {
+		DeviceID int32
+		LastSeen time.Time
+	}
+	stmt := SELECT(Measurement.DeviceID.AS("device_id"), MAX(Measurement.CreatedAt).AS("last_seen")).
+		FROM(Measurement).
+		GROUP_BY(Measurement.DeviceID)
+	if err := stmt.Query(db, &newest); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		return err
+	}
+
+	availabilityLock.Lock()
+	defer availabilityLock.Unlock()
+	for _, n := range newest {
+		lastReadings[n.DeviceID] = n.LastSeen
+	}
+	for _, a := range availabilities {
+		if at, ok := lastReadings[a.device.ID]; ok && at.Before(a.lastSeen) {
+			a.lastSeen = at
+		}
+	}
+	return nil
+}
+
+// trackDevice starts following the availability of the device from its last stored reading. A newly
+// tracked device without one gets one offline period of grace before it is reported offline.
+func trackDevice(device model.Device) {
+	availabilityLock.Lock()
+	defer availabilityLock.Unlock()
+
+	key := strings.ToLower(device.Mac)
+	if a, ok := availabilities[key]; ok {
+		a.device = device
+		return
+	}
+	lastSeen := time.Now()
+	if at, ok := lastReadings[device.ID]; ok && at.Before(lastSeen) {
+		lastSeen = at
+	}
+	availabilities[key] = &deviceAvailability{device: device, lastSeen: lastSeen}
+}
+
+func untrackDevice(device model.Device) {
+	availabilityLock.Lock()
+	defer availabilityLock.Unlock()
+
+	delete(availabilities, strings.ToLower(device.Mac))
+}
+
+// markSeen records a measurement from the device taken at the given time and reports the device online if
+// it was not already. Older measurements, e.g. drained from the spool, do not move the last seen time back,
+// and a measurement that is older than the offline period does not bring the device back online.
+func markSeen(device model.Device, at time.Time) {
+	availabilityLock.Lock()
+	a, ok := availabilities[strings.ToLower(device.Mac)]
+	if !ok {
+		a = &deviceAvailability{device: device}
+		availabilities[strings.ToLower(device.Mac)] = a
+	}
+	if at.After(a.lastSeen) {
+		a.lastSeen = at
+	}
+	publish := a.state != payloadOnline && time.Since(at) <= offlineAfter
+	if publish {
+		returnedAt := at
+		a.returnedAt = &returnedAt
+		a.state = payloadOnline
+	}
+	availabilityLock.Unlock()
+
+	if publish {
+		publishMqtt(deviceAvailabilityTopic(device), true, []byte(payloadOnline))
+		log.Info().Msgf("Device %s is online", device.Label)
+	}
+}
+
+// watchAvailability reports devices offline when they have been silent for too long, and queues them
+// for runGaps as stale, or as returned when they report again
+func watchAvailability() {
+	ticker := time.NewTicker(availabilityCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		offline := []gapEvent{}
+		returned := []gapEvent{}
+
+		availabilityLock.Lock()
+		for _, a := range availabilities {
+			if a.returnedAt != nil {
+				returned = append(returned, gapEvent{device: a.device, at: *a.returnedAt})
+				a.returnedAt = nil
+			}
+			if a.state != payloadOffline && time.Since(a.lastSeen) > offlineAfter {
+				a.state = payloadOffline
+				offline = append(offline, gapEvent{device: a.device, at: a.lastSeen, stale: true})
+			}
+		}
+		availabilityLock.Unlock()
+
+		for _, r := range returned {
+			queueGapEvent(r)
+		}
+		for _, o := range offline {
+			publishMqtt(deviceAvailabilityTopic(o.device), true, []byte(payloadOffline))
+			log.Warn().Msgf("Device %s has not reported in %s, it is offline", o.device.Label, offlineAfter)
+			queueGapEvent(o)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Battery health. The voltage of the CR2477 in a tag sags in the cold, so readings are compensated to the
+// reference temperature before they are smoothed with a moving average. The trend of the daily rollups
+// predicts when the compensated voltage reaches the replacement threshold, and the built in battery-low
+// alert rule fires when the smoothed voltage crosses it. Voltages are in mV as in the measurement API.
+// After a restart the average of a device starts from its latest hourly rollup, so that a single reading
+// does not decide the battery-low alert.
+
+const (
+	batteryAlertRule = "battery-low"
+
+	defaultBatteryReplaceBelow         = 2500
+	defaultBatteryCompensation         = 12.5
+	defaultBatteryReferenceTemperature = 20
+	defaultBatteryHysteresis           = 50
+	defaultBatterySmoothing            = 24 * time.Hour
+	defaultBatteryTrendDays            = 90
+
+	// minBatteryTrendDays of rollups are needed for a prediction
+	minBatteryTrendDays      = 7
+	batteryTrendInterval     = time.Hour
+	maxBatteryPredictionDays = 10 * 365
+)
+
+type BatteryConfig struct {
+	// ReplaceBelow is the compensated voltage in mV at which the battery should be replaced
+	ReplaceBelow float64 `yaml:"replaceBelow"`
+	// Compensation in mV per °C that is added to readings below the reference temperature
+	Compensation         float64 `yaml:"compensation"`
+	ReferenceTemperature float64 `yaml:"referenceTemperature"`
+	// Smoothing is the time constant of the moving average of the compensated voltage
+	Smoothing time.Duration `yaml:"smoothing"`
+	// TrendDays of daily rollups the prediction is fitted to
+	TrendDays int `yaml:"trendDays"`
+	// Alert enables the battery-low alert rule, resolved once the voltage is the hysteresis above the threshold
+	Alert      bool     `yaml:"alert"`
+	Hysteresis float64  `yaml:"hysteresis"`
+	Notify     []string `yaml:"notify"`
+}
+
+type BatteryJson struct {
+	MAC   string `json:"mac"`
+	Label string `json:"label"`
+	// Voltage and Temperature of the latest reading
+	Voltage     *int32   `json:"voltage"`
+	Temperature *float64 `json:"temperature"`
+	// Compensated is the smoothed voltage at the reference temperature
+	Compensated  *float64 `json:"compensated"`
+	ReplaceBelow float64  `json:"replaceBelow"`
+	Low          bool     `json:"low"`
+	// TrendPerDay is the change of the compensated voltage in mV per day, fitted to TrendDays of rollups
+	TrendPerDay *float64   `json:"trendPerDay"`
+	TrendDays   int        `json:"trendDays"`
+	ReplaceAt   *time.Time `json:"replaceAt"`
+	UpdatedAt   *time.Time `json:"updatedAt,omitempty"`
+}
+
+type batteryState struct {
+	voltage     *int32
+	temperature *float64
+	// smoothed compensated voltage, nil until the first reading
+	smoothed  *float64
+	updatedAt time.Time
+	trend     *batteryTrend
+	// seeded is whether the average was started from the rollups
+	seeded bool
+}
+
+type batteryTrend struct {
+	perDay float64
+	days   int
+}
+
+var (
+	// batteryStates by device ID, guarded by batteryLock
+	batteryStates = map[int32]*batteryState{}
+	batteryLock   sync.Mutex
+)
+
+func defaultBatteryConfig() BatteryConfig {
+	return BatteryConfig{
+		ReplaceBelow:         defaultBatteryReplaceBelow,
+		Compensation:         defaultBatteryCompensation,
+		ReferenceTemperature: defaultBatteryReferenceTemperature,
+		Smoothing:            defaultBatterySmoothing,
+		TrendDays:            defaultBatteryTrendDays,
+		Alert:                true,
+		Hysteresis:           defaultBatteryHysteresis,
+	}
+}
+
+func checkBatteryConfig(c BatteryConfig, alerts AlertsConfig) error {
+	if c.ReplaceBelow <= 0 {
+		return fmt.Errorf("battery replaceBelow must be positive")
+	}
+	if c.Compensation < 0 || c.Hysteresis < 0 {
+		return fmt.Errorf("battery compensation and hysteresis must not be negative")
+	}
+	if c.Smoothing <= 0 {
+		return fmt.Errorf("battery smoothing must be positive")
+	}
+	if c.TrendDays < minBatteryTrendDays {
+		return fmt.Errorf("battery trendDays must be at least %d", minBatteryTrendDays)
+	}
+	for _, rule := range alerts.Rules {
+		if c.Alert && rule.Name == batteryAlertRule {
+			return fmt.Errorf("alert rule %s is built in, disable battery alert to configure it", batteryAlertRule)
+		}
+	}
+	notifiers := map[string]bool{}
+	for _, n := range alerts.Notifiers {
+		notifiers[n.Name] = true
+	}
+	for _, name := range c.Notify {
+		if !notifiers[name] {
+			return fmt.Errorf("battery: unknown notifier %s", name)
+		}
+	}
+	return nil
+}
+
+// compensateBattery returns the voltage the battery would have at the reference temperature
+func compensateBattery(voltage float64, temperature *float64) float64 {
+	if temperature == nil || *temperature >= config.Battery.ReferenceTemperature {
+		return voltage
+	}
+	return voltage + config.Battery.Compensation*(config.Battery.ReferenceTemperature-*temperature)
+}
+
+// trackBattery adds the reading to the moving average of the device. Readings older than the average,
+// e.g. from the spool, are left out.
+func trackBattery(device model.Device, m *MeasurementJson) {
+	if m.Battery == nil {
+		return
+	}
+	at := measurementTime(m)
+	compensated := compensateBattery(float64(*m.Battery), m.Temperature)
+	seedBattery(device, at)
+
+	batteryLock.Lock()
+	defer batteryLock.Unlock()
+	state, ok := batteryStates[device.ID]
+	if !ok {
+		state = &batteryState{}
+		batteryStates[device.ID] = state
+	}
+	if state.smoothed != nil && !at.After(state.updatedAt) {
+		return
+	}
+
+	state.voltage, state.temperature = m.Battery, m.Temperature
+	if state.smoothed == nil {
+		state.smoothed = &compensated
+	} else {
+		// Exponential moving average over irregular intervals
+		alpha := 1 - math.Exp(-float64(at.Sub(state.updatedAt))/float64(config.Battery.Smoothing))
+		smoothed := *state.smoothed + alpha*(compensated-*state.smoothed)
+		state.smoothed = &smoothed
+	}
+	state.updatedAt = at
+}
+
+// seedBattery starts the moving average of the device from its latest hourly rollup before at, once
+func seedBattery(device model.Device, at time.Time) {
+	batteryLock.Lock()
+	state, ok := batteryStates[device.ID]
+	seeded := ok && (state.seeded || state.smoothed != nil)
+	batteryLock.Unlock()
+	if seeded {
+		return
+	}
+
+	var latest []model.MeasurementHourly
+	stmt := SELECT(MeasurementHourly.AllColumns).
+		FROM(MeasurementHourly).
+		WHERE(
+			MeasurementHourly.DeviceID.EQ(Int32(device.ID)).
+				AND(MeasurementHourly.CreatedAt.LT(TimestampzT(at))).
+				AND(MeasurementHourly.BatteryAvg.IS_NOT_NULL()),
+		).
+		ORDER_BY(MeasurementHourly.CreatedAt.DESC()).
+		LIMIT(1)
+	if err := stmt.Query(db, &latest); err != nil {
+		// Start from the reading instead, like for a new device
+		log.Error().Err(err).Msgf("Failed to read the battery history of %s", device.Mac)
+	}
+
+	batteryLock.Lock()
+	defer batteryLock.Unlock()
+	state, ok = batteryStates[device.ID]
+	if !ok {
+		state = &batteryState{}
+		batteryStates[device.ID] = state
+	}
+	state.seeded = true
+	if state.smoothed != nil || len(latest) == 0 {
+		return
+	}
+	smoothed := compensateBattery(*latest[0].BatteryAvg, latest[0].TemperatureAvg)
+	state.smoothed = &smoothed
+	state.voltage = roundToInt32(*latest[0].BatteryAvg, 1)
+	state.temperature = latest[0].TemperatureAvg
+	state.updatedAt = latest[0].CreatedAt
+}
+
+// batteryRule is the built in battery-low alert rule
+func batteryRule() AlertRule {
+	threshold := config.Battery.ReplaceBelow
+	return AlertRule{
+		Name:       batteryAlertRule,
+		Field:      "battery",
+		Below:      &threshold,
+		Hysteresis: config.Battery.Hysteresis,
+		Notify:     config.Battery.Notify,
+	}
+}
+
+// smoothedBatteryMeasurement returns the measurement with the smoothed compensated voltage of the device
+// as its battery, for the battery-low rule
+func smoothedBatteryMeasurement(device model.Device, m *MeasurementJson) *MeasurementJson {
+	batteryLock.Lock()
+	defer batteryLock.Unlock()
+
+	smoothed := *m
+	smoothed.Battery = nil
+	if state, ok := batteryStates[device.ID]; ok && m.Battery != nil && state.smoothed != nil {
+		smoothed.Battery = roundToInt32(*state.smoothed, 1)
+	}
+	return &smoothed
+}
+
+// fitBatteryTrend fits a line to the compensated daily voltages and returns its slope in mV per day
+func fitBatteryTrend(days []model.MeasurementDaily) (batteryTrend, bool) {
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, day := range days {
+		if day.BatteryAvg == nil {
+			continue
+		}
+		x := day.CreatedAt.Sub(days[0].CreatedAt).Hours() / 24
+		y := compensateBattery(*day.BatteryAvg, day.TemperatureAvg)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if n < minBatteryTrendDays || denominator == 0 {
+		return batteryTrend{}, false
+	}
+	return batteryTrend{perDay: (n*sumXY - sumX*sumY) / denominator, days: int(n)}, true
+}
+
+// updateBatteryTrend fits the trend of the device to its daily rollups
+func updateBatteryTrend(device model.Device) error {
+	var days []model.MeasurementDaily
+	stmt := SELECT(MeasurementDaily.AllColumns).
+		FROM(MeasurementDaily).
+		WHERE(
+			MeasurementDaily.DeviceID.EQ(Int32(device.ID)).
+				AND(MeasurementDaily.CreatedAt.GT_EQ(TimestampzT(time.Now().AddDate(0, 0, -config.Battery.TrendDays)))),
+		).
+		ORDER_BY(MeasurementDaily.CreatedAt)
+	if err := stmt.Query(db, &days); err != nil {
+		return err
+	}
+
+	trend, ok := fitBatteryTrend(days)
+	batteryLock.Lock()
+	defer batteryLock.Unlock()
+	state, has := batteryStates[device.ID]
+	if !has {
+		state = &batteryState{}
+		batteryStates[device.ID] = state
+	}
+	state.trend = nil
+	if ok {
+		state.trend = &trend
+	}
+	return nil
+}
+
+// runBatteryTrends updates the trends of all active devices every interval
+func runBatteryTrends() {
+	ticker := time.NewTicker(batteryTrendInterval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		devicesLock.RLock()
+		activeDevices := []model.Device{}
+		for _, device := range devices {
+			activeDevices = append(activeDevices, device)
+		}
+		devicesLock.RUnlock()
+
+		for _, device := range activeDevices {
+			if err := updateBatteryTrend(device); err != nil {
+				log.Error().Err(err).Msgf("Failed to update battery trend of %s", device.Mac)
+			}
+		}
+	}
+}
+
+// batteryHealth returns the battery health of the device and when the battery is predicted to need replacing
+func batteryHealth(device model.Device) BatteryJson {
+	health := BatteryJson{MAC: device.Mac, Label: device.Label, ReplaceBelow: config.Battery.ReplaceBelow}
+
+	batteryLock.Lock()
+	defer batteryLock.Unlock()
+	state, ok := batteryStates[device.ID]
+	if !ok {
+		return health
+	}
+	if state.trend != nil {
+		perDay := state.trend.perDay
+		health.TrendPerDay = &perDay
+		health.TrendDays = state.trend.days
+	}
+	if state.smoothed == nil {
+		return health
+	}
+
+	compensated := *state.smoothed
+	updatedAt := state.updatedAt
+	health.Voltage, health.Temperature = state.voltage, state.temperature
+	health.Compensated = &compensated
+	health.UpdatedAt = &updatedAt
+	health.Low = compensated < config.Battery.ReplaceBelow
+	switch {
+	case health.Low:
+		health.ReplaceAt = &updatedAt
+	case health.TrendPerDay != nil && *health.TrendPerDay < 0:
+		days := (compensated - config.Battery.ReplaceBelow) / -*health.TrendPerDay
+		if days < maxBatteryPredictionDays {
+			replaceAt := updatedAt.Add(time.Duration(days * float64(24*time.Hour))).Truncate(time.Hour)
+			health.ReplaceAt = &replaceAt
+		}
+	}
+	return health
+}
+
+// getBatteries lists the battery health of all active devices, those to be replaced first
+func getBatteries(c echo.Context) error {
+	if err := loadDevices(); err != nil {
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+	devicesLock.RLock()
+	result := []BatteryJson{}
+	for _, device := range devices {
+		result = append(result, batteryHealth(device))
+	}
+	devicesLock.RUnlock()
+
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].ReplaceAt, result[j].ReplaceAt
+		if a == nil || b == nil {
+			return a != nil || (b == nil && result[i].Label < result[j].Label)
+		}
+		return a.Before(*b)
+	})
+	return c.JSON(200, result)
+}
+
+func getDeviceBattery(c echo.Context) error {
+	mac, err := normalizeMac(c.Param("mac"))
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	device, err := lookupDevice(mac)
+	if errors.Is(err, errUnknownDevice) {
+		return echo.NewHTTPError(404, "Device not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(500, "Failed to read device")
+	}
+	return c.JSON(200, batteryHealth(device))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+)
+
+// Measurements are stored in time buckets, one row per device and bucket. Readings that fall in a
+// bucket that already has a row are merged into it.
+
+const (
+	// MergeFirst keeps the first reading of the bucket
+	MergeFirst = "first"
+	// MergeLast replaces the bucket with the latest reading, fields missing from it are kept
+	MergeLast = "last"
+	// MergeAverage keeps the running average of the readings in the bucket
+	MergeAverage = "average"
+	// MergeRaw keeps every reading with its own time, the bucket size is not used
+	MergeRaw = "raw"
+
+	defaultBucketSize = time.Minute
+)
+
+// BucketRule is how readings are bucketed. Unset values fall back to the defaults.
+type BucketRule struct {
+	Size  time.Duration `yaml:"size"`
+	Merge string        `yaml:"merge"`
+}
+
+type BucketConfig struct {
+	BucketRule `yaml:",inline"`
+	// Devices override the rule for a device, given by MAC or label
+	Devices map[string]BucketRule `yaml:"devices"`
+}
+
+func defaultBucketConfig() BucketConfig {
+	return BucketConfig{BucketRule: BucketRule{Size: defaultBucketSize, Merge: MergeFirst}}
+}
+
+func checkBucketRule(rule BucketRule) error {
+	if rule.Size < 0 {
+		return fmt.Errorf("bucket size %s is negative", rule.Size)
+	}
+	switch rule.Merge {
+	case "", MergeFirst, MergeLast, MergeAverage, MergeRaw:
+		return nil
+	default:
+		return fmt.Errorf("unknown merge strategy %s, use %s, %s, %s or %s", rule.Merge, MergeFirst, MergeLast, MergeAverage, MergeRaw)
+	}
+}
+
+func checkBucketConfig(c BucketConfig) error {
+	if err := checkBucketRule(c.BucketRule); err != nil {
+		return err
+	}
+	for key, rule := range c.Devices {
+		if err := checkBucketRule(rule); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// bucketRule returns the bucketing of the device. The rule by label overrides the global rule, and the rule
+// by MAC overrides both.
+func bucketRule(device model.Device) BucketRule {
+	rule := config.Buckets.BucketRule
+	override := func(deviceRule BucketRule) {
+		if deviceRule.Size > 0 {
+			rule.Size = deviceRule.Size
+		}
+		if deviceRule.Merge != "" {
+			rule.Merge = deviceRule.Merge
+		}
+	}
+	if deviceRule, ok := config.Buckets.Devices[device.Label]; ok && device.Label != "" {
+		override(deviceRule)
+	}
+	for key, deviceRule := range config.Buckets.Devices {
+		if strings.EqualFold(key, device.Mac) || normalizedMacEquals(key, device.Mac) {
+			override(deviceRule)
+			break
+		}
+	}
+	if rule.Size <= 0 {
+		rule.Size = defaultBucketSize
+	}
+	if rule.Merge == "" {
+		rule.Merge = MergeFirst
+	}
+	return rule
+}
+
+// bucketTime returns the start of the bucket that the time falls in
+func (rule BucketRule) bucketTime(t time.Time) time.Time {
+	if rule.Merge == MergeRaw {
+		return t
+	}
+	return t.Truncate(rule.Size)
+}
+
+// averagedColumn is a column that MergeAverage averages, with the column that counts the readings behind
+// its value. A reading may lack some of the fields, so they are counted apart from sample_count.
+type averagedColumn struct {
+	name  string
+	count ColumnInteger
+}
+
+func averagedColumns() []averagedColumn {
+	return []averagedColumn{
+		{"temperature", Measurement.TemperatureCount},
+		{"humidity", Measurement.HumidityCount},
+		{"pressure", Measurement.PressureCount},
+		{"acceleration_x", Measurement.AccelerationXCount},
+		{"acceleration_y", Measurement.AccelerationYCount},
+		{"acceleration_z", Measurement.AccelerationZCount},
+		{"battery_voltage", Measurement.BatteryVoltageCount},
+		{"rssi", Measurement.RssiCount},
+	}
+}
+
+// readingCount is the count of a value of a single reading
+func readingCount[T any](value *T) *int32 {
+	count := int32(0)
+	if value != nil {
+		count = 1
+	}
+	return &count
+}
+
+// storedCount is the number of readings behind the stored value of the column. Rows from before the
+// counts were kept count every sample.
+func storedCount(column string) string {
+	return fmt.Sprintf("(CASE WHEN measurement.%[1]s IS NULL THEN 0 ELSE COALESCE(measurement.%[1]s_count, measurement.sample_count) END)", column)
+}
+
+// lastAssignments take the fields of the new reading, keeping the stored ones that it does not have
+func lastAssignments() []ColumnAssigment {
+	keep := func(column string) string {
+		return fmt.Sprintf("COALESCE(excluded.%[1]s, measurement.%[1]s)", column)
+	}
+	assignments := []ColumnAssigment{
+		Measurement.Temperature.SET(RawFloat(keep("temperature"))),
+		Measurement.Humidity.SET(RawFloat(keep("humidity"))),
+		Measurement.Pressure.SET(RawInt(keep("pressure"))),
+		Measurement.AccelerationX.SET(RawInt(keep("acceleration_x"))),
+		Measurement.AccelerationY.SET(RawInt(keep("acceleration_y"))),
+		Measurement.AccelerationZ.SET(RawInt(keep("acceleration_z"))),
+		Measurement.BatteryVoltage.SET(RawInt(keep("battery_voltage"))),
+		Measurement.TxPower.SET(RawInt(keep("tx_power"))),
+		Measurement.MovementCounter.SET(RawInt(keep("movement_counter"))),
+		Measurement.MeasurementSequenceNumber.SET(RawInt(keep("measurement_sequence_number"))),
+		Measurement.Rssi.SET(RawInt(keep("rssi"))),
+		Measurement.Gateway.SET(RawString(keep("gateway"))),
+		Measurement.SampleCount.SET(RawInt("measurement.sample_count + 1")),
+	}
+	for _, column := range averagedColumns() {
+		assignments = append(assignments, column.count.SET(RawInt(fmt.Sprintf(
+			"CASE WHEN excluded.%[1]s IS NULL THEN measurement.%[1]s_count ELSE 1 END", column.name))))
+	}
+	return assignments
+}
+
+// averageAssignments keep the running average of the sensor values, each over the readings that had it.
+// Counters and tx power are not averaged, they take the latest value.
+func averageAssignments() []ColumnAssigment {
+	// When either value is missing the average is NULL and the other value is used
+	average := func(column string) string {
+		return fmt.Sprintf("COALESCE((measurement.%[1]s * %[2]s + excluded.%[1]s) / (%[2]s + 1), excluded.%[1]s, measurement.%[1]s)", column, storedCount(column))
+	}
+	averageInt := func(column string) string {
+		return fmt.Sprintf("COALESCE(ROUND((measurement.%[1]s * %[2]s + excluded.%[1]s)::numeric / (%[2]s + 1)), excluded.%[1]s, measurement.%[1]s)", column, storedCount(column))
+	}
+	keep := func(column string) string {
+		return fmt.Sprintf("COALESCE(excluded.%[1]s, measurement.%[1]s)", column)
+	}
+	assignments := []ColumnAssigment{
+		Measurement.Temperature.SET(RawFloat(average("temperature"))),
+		Measurement.Humidity.SET(RawFloat(average("humidity"))),
+		Measurement.Pressure.SET(RawInt(averageInt("pressure"))),
+		Measurement.AccelerationX.SET(RawInt(averageInt("acceleration_x"))),
+		Measurement.AccelerationY.SET(RawInt(averageInt("acceleration_y"))),
+		Measurement.AccelerationZ.SET(RawInt(averageInt("acceleration_z"))),
+		Measurement.BatteryVoltage.SET(RawInt(averageInt("battery_voltage"))),
+		Measurement.TxPower.SET(RawInt(keep("tx_power"))),
+		Measurement.MovementCounter.SET(RawInt(keep("movement_counter"))),
+		Measurement.MeasurementSequenceNumber.SET(RawInt(keep("measurement_sequence_number"))),
+		Measurement.Rssi.SET(RawInt(averageInt("rssi"))),
+		Measurement.Gateway.SET(RawString(keep("gateway"))),
+		Measurement.SampleCount.SET(RawInt("measurement.sample_count + 1")),
+	}
+	for _, column := range averagedColumns() {
+		assignments = append(assignments, column.count.SET(RawInt(fmt.Sprintf(
+			"%s + CASE WHEN excluded.%s IS NULL THEN 0 ELSE 1 END", storedCount(column.name), column.name))))
+	}
+	return assignments
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+func TestBucketTime(t *testing.T) {
+	at := time.Date(2024, 3, 10, 14, 37, 42, 123456789, time.UTC)
+	tests := []struct {
+		name string
+		rule BucketRule
+		t    time.Time
+		want time.Time
+	}{
+		{name: "minute", rule: BucketRule{Size: time.Minute, Merge: MergeFirst}, t: at,
+			want: time.Date(2024, 3, 10, 14, 37, 0, 0, time.UTC)},
+		{name: "five minutes", rule: BucketRule{Size: 5 * time.Minute, Merge: MergeAverage}, t: at,
+			want: time.Date(2024, 3, 10, 14, 35, 0, 0, time.UTC)},
+		{name: "hour", rule: BucketRule{Size: time.Hour, Merge: MergeLast}, t: at,
+			want: time.Date(2024, 3, 10, 14, 0, 0, 0, time.UTC)},
+		{name: "ten seconds", rule: BucketRule{Size: 10 * time.Second, Merge: MergeFirst}, t: at,
+			want: time.Date(2024, 3, 10, 14, 37, 40, 0, time.UTC)},
+		{name: "start of a bucket", rule: BucketRule{Size: time.Minute, Merge: MergeFirst},
+			t:    time.Date(2024, 3, 10, 14, 37, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 10, 14, 37, 0, 0, time.UTC)},
+		{name: "end of a bucket", rule: BucketRule{Size: time.Minute, Merge: MergeFirst},
+			t:    time.Date(2024, 3, 10, 14, 37, 59, 999999999, time.UTC),
+			want: time.Date(2024, 3, 10, 14, 37, 0, 0, time.UTC)},
+		{name: "raw keeps the time", rule: BucketRule{Size: time.Minute, Merge: MergeRaw}, t: at, want: at},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.bucketTime(tt.t); !got.Equal(tt.want) {
+				t.Errorf("bucketTime() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketRule(t *testing.T) {
+	previousConfig := config
+	t.Cleanup(func() { config = previousConfig })
+	config = defaultConfig()
+	config.Buckets = BucketConfig{
+		BucketRule: BucketRule{Size: 5 * time.Minute},
+		Devices: map[string]BucketRule{
+			"AA:BB:CC:DD:EE:01": {Merge: MergeAverage},
+			"sauna":             {Size: 10 * time.Second, Merge: MergeLast},
+			"garage":            {Size: time.Hour, Merge: MergeLast},
+			"aa-bb-cc-dd-ee-03": {Merge: MergeAverage},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		device model.Device
+		want   BucketRule
+	}{
+		{name: "global rule with the default merge", device: model.Device{Mac: "aa:bb:cc:dd:ee:00"},
+			want: BucketRule{Size: 5 * time.Minute, Merge: MergeFirst}},
+		{name: "device by mac keeps the global size", device: model.Device{Mac: "aa:bb:cc:dd:ee:01"},
+			want: BucketRule{Size: 5 * time.Minute, Merge: MergeAverage}},
+		{name: "device by label", device: model.Device{Mac: "aa:bb:cc:dd:ee:02", Label: "sauna"},
+			want: BucketRule{Size: 10 * time.Second, Merge: MergeLast}},
+		{name: "device by mac overrides the one by label", device: model.Device{Mac: "aa:bb:cc:dd:ee:03", Label: "garage"},
+			want: BucketRule{Size: time.Hour, Merge: MergeAverage}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Rules must not depend on the order of the device map
+			for range 20 {
+				if got := bucketRule(tt.device); got != tt.want {
+					t.Fatalf("bucketRule() = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	config.Buckets = BucketConfig{}
+	if got, want := bucketRule(model.Device{Mac: "aa:bb:cc:dd:ee:00"}), (BucketRule{Size: defaultBucketSize, Merge: MergeFirst}); got != want {
+		t.Errorf("bucketRule() without configuration = %+v, want %+v", got, want)
+	}
+}
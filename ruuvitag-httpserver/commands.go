@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Admin subcommands, run as ruuvitag-httpserver <command> [arguments]. Without a command the server starts.
+
+const commandUsage = `Usage:
+  ruuvitag-httpserver                               start the server, applying pending migrations first
+  ruuvitag-httpserver migrate                       apply pending database migrations
+  ruuvitag-httpserver migrate status                list migrations and when they were applied
+  ruuvitag-httpserver token create <name> [scope]   create a token for a reader, gateway or admin, scope is ingest (default) or admin
+  ruuvitag-httpserver token list                    list tokens
+  ruuvitag-httpserver token revoke <name>           revoke the token
+  ruuvitag-httpserver alerts test [notifier]        send a test notification to the notifier, or to all notifiers`
+
+// runCommand runs the subcommand and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "token":
+		return runTokenCommand(args[1:])
+	case "alerts":
+		return runAlertsCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(commandUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n%s\n", args[0], commandUsage)
+		return 2
+	}
+}
+
+func runMigrateCommand(args []string) int {
+	switch {
+	case len(args) == 0:
+		count, err := migrate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to migrate: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Applied %d migrations\n", count)
+		return 0
+	case args[0] == "status" && len(args) == 1:
+		migrations, applied, err := migrationStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read migrations: %v\n", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range migrations {
+			appliedAt := "pending"
+			if a, ok := applied[m.version]; ok {
+				appliedAt = formatCommandTime(&a.appliedAt)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.version, m.name, appliedAt)
+		}
+		w.Flush()
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return 2
+	}
+}
+
+func runTokenCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return 2
+	}
+
+	switch {
+	case args[0] == "create" && (len(args) == 2 || len(args) == 3):
+		scope := TokenScopeIngest
+		if len(args) == 3 {
+			scope = args[2]
+		}
+		token, plain, err := createToken(args[1], scope)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create token: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Created %s token %s with id %d. It is not shown again.\n\n", token.Scope, token.Name, token.ID)
+		fmt.Printf("Token:       %s\n", plain)
+		if key := signingKey(token.TokenHash); key != "" {
+			fmt.Printf("Signing key: %s\n", key)
+		} else {
+			fmt.Println("No signing key, set TOKEN_SIGNING_SECRET in .env for signed requests")
+		}
+		return 0
+	case args[0] == "list" && len(args) == 1:
+		tokens, err := listTokens()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list tokens: %v\n", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPE\tCREATED\tLAST USED\tREVOKED")
+		for _, token := range tokens {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, token.Scope,
+				formatCommandTime(&token.CreatedAt), formatCommandTime(token.LastUsedAt), formatCommandTime(token.RevokedAt))
+		}
+		w.Flush()
+		return 0
+	case args[0] == "revoke" && len(args) == 2:
+		if err := revokeToken(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to revoke token: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Revoked token %s\n", args[1])
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return 2
+	}
+}
+
+func runAlertsCommand(args []string) int {
+	if len(args) == 0 || args[0] != "test" || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return 2
+	}
+	name := ""
+	if len(args) == 2 {
+		name = args[1]
+	}
+	sent, err := sendTestNotification(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to notify: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Sent test notification to %d notifiers\n", sent)
+	return 0
+}
+
+func formatCommandTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Structured configuration from config.yml. Connection settings and secrets stay in .env.
+// See config.example.yml for all options.
+
+const configPath = "config.yml"
+
+type Config struct {
+	Validation   ValidationConfig   `yaml:"validation"`
+	Buckets      BucketConfig       `yaml:"buckets"`
+	Retention    RetentionConfig    `yaml:"retention"`
+	Storage      StorageConfig      `yaml:"storage"`
+	LineProtocol LineProtocolConfig `yaml:"lineProtocol"`
+	Devices      DevicesConfig      `yaml:"devices"`
+	Spool        SpoolConfig        `yaml:"spool"`
+	Alerts       AlertsConfig       `yaml:"alerts"`
+	Battery      BatteryConfig      `yaml:"battery"`
+	Stale        StaleConfig        `yaml:"stale"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Validation: ValidationConfig{
+			Fields: defaultValidationFields(),
+		},
+		Buckets:      defaultBucketConfig(),
+		Retention:    defaultRetentionConfig(),
+		Storage:      defaultStorageConfig(),
+		LineProtocol: defaultLineProtocolConfig(),
+		Devices:      defaultDevicesConfig(),
+		Spool:        defaultSpoolConfig(),
+		Battery:      defaultBatteryConfig(),
+		Stale:        defaultStaleConfig(),
+	}
+}
+
+// loadConfigFile reads config.yml on top of the defaults. The file is optional.
+func loadConfigFile() error {
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info().Msgf("No %s, using default configuration", configPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loaded := Config{Buckets: defaultBucketConfig(), Retention: defaultRetentionConfig(), Storage: defaultStorageConfig(),
+		Devices: defaultDevicesConfig(), Spool: defaultSpoolConfig(), Battery: defaultBatteryConfig(),
+		Stale: defaultStaleConfig()}
+	if err := yaml.UnmarshalStrict(data, &loaded); err != nil {
+		return err
+	}
+
+	fields := defaultValidationFields()
+	for field, rule := range loaded.Validation.Fields {
+		fields[field] = rule
+	}
+	loaded.Validation.Fields = fields
+	lineFields := defaultLineProtocolConfig().Fields
+	for field, mapping := range loaded.LineProtocol.Fields {
+		lineFields[field] = mapping
+	}
+	loaded.LineProtocol.Fields = lineFields
+	if loaded.LineProtocol.MacTags == nil {
+		loaded.LineProtocol.MacTags = defaultLineProtocolConfig().MacTags
+	}
+	if loaded.LineProtocol.LabelTags == nil {
+		loaded.LineProtocol.LabelTags = defaultLineProtocolConfig().LabelTags
+	}
+	if err := checkValidationConfig(loaded.Validation); err != nil {
+		return err
+	}
+	if err := checkBucketConfig(loaded.Buckets); err != nil {
+		return err
+	}
+	if err := checkRetentionConfig(loaded.Retention); err != nil {
+		return err
+	}
+	if err := checkStorageConfig(loaded.Storage); err != nil {
+		return err
+	}
+	if err := checkLineProtocolConfig(loaded.LineProtocol); err != nil {
+		return err
+	}
+	if err := checkDevicesConfig(loaded.Devices); err != nil {
+		return err
+	}
+	if err := checkSpoolConfig(loaded.Spool); err != nil {
+		return err
+	}
+	if err := checkAlertsConfig(loaded.Alerts); err != nil {
+		return err
+	}
+	if err := checkBatteryConfig(loaded.Battery, loaded.Alerts); err != nil {
+		return err
+	}
+	if err := checkStaleConfig(loaded.Stale, loaded.Alerts); err != nil {
+		return err
+	}
+
+	config = loaded
+	return nil
+}
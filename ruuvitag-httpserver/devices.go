@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DeviceStatusActive  = "active"
+	DeviceStatusPending = "pending"
+	DeviceStatusRetired = "retired"
+)
+
+var (
+	errUnknownDevice  = errors.New("unknown mac")
+	errInvalidMac     = errors.New("invalid mac")
+	errInactiveDevice = errors.New("inactive device")
+)
+
+type DeviceJson struct {
+	ID     int32  `json:"id"`
+	MAC    string `json:"mac"`
+	Label  string `json:"label"`
+	Status string `json:"status"`
+	// Seen times and RSSI are tracked for pending devices
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	Rssi      *int32     `json:"rssi,omitempty"`
+}
+
+var (
+	// devices caches active devices by lowercase MAC, guarded by devicesLock
+	devices       = map[string]model.Device{}
+	devicesLoaded = false
+	devicesLock   sync.RWMutex
+)
+
+func toDeviceJson(device model.Device) DeviceJson {
+	return DeviceJson{
+		ID:        device.ID,
+		MAC:       device.Mac,
+		Label:     device.Label,
+		Status:    device.Status,
+		FirstSeen: device.FirstSeen,
+		LastSeen:  device.LastSeen,
+		Rssi:      device.Rssi,
+	}
+}
+
+// normalizeMac validates the MAC address and returns it in lowercase colon separated form. Besides the
+// forms of net.ParseMAC it takes the 12 hex digits without separators that some gateways send.
+func normalizeMac(mac string) (string, error) {
+	if raw, err := hex.DecodeString(mac); err == nil && len(raw) == 6 {
+		return net.HardwareAddr(raw).String(), nil
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("%w %s", errInvalidMac, mac)
+	}
+	return hw.String(), nil
+}
+
+// deviceKey is the key of the MAC in the device cache, so that AA-BB-CC-DD-EE-FF and aabb.ccdd.eeff find the
+// device of aa:bb:cc:dd:ee:ff. Invalid MACs are only lowercased, they are never cached.
+func deviceKey(mac string) string {
+	if normalized, err := normalizeMac(mac); err == nil {
+		return normalized
+	}
+	return strings.ToLower(mac)
+}
+
+// loadDevices fills the device cache from the database once and publishes Home Assistant discovery for
+// each device. syncDevices keeps it current after that.
+func loadDevices() error {
+	devicesLock.RLock()
+	loaded := devicesLoaded
+	devicesLock.RUnlock()
+
+	if loaded {
+		return nil
+	}
+	return reloadDevices()
+}
+
+func lookupDevice(mac string) (model.Device, error) {
+	if err := loadDevices(); err != nil {
+		return model.Device{}, err
+	}
+
+	devicesLock.RLock()
+	device, has := devices[deviceKey(mac)]
+	devicesLock.RUnlock()
+
+	if !has {
+		return model.Device{}, fmt.Errorf("%w %s", errUnknownDevice, mac)
+	}
+	return device, nil
+}
+
+// cachedDevice returns the active device from the cache, without loading the cache when it is not loaded yet
+func cachedDevice(mac string) (model.Device, bool) {
+	devicesLock.RLock()
+	defer devicesLock.RUnlock()
+	device, has := devices[deviceKey(mac)]
+	return device, has
+}
+
+// lookupDeviceByLabel returns the active device with the label
+func lookupDeviceByLabel(label string) (model.Device, error) {
+	if err := loadDevices(); err != nil {
+		return model.Device{}, err
+	}
+
+	devicesLock.RLock()
+	defer devicesLock.RUnlock()
+	for _, device := range devices {
+		if device.Label == label {
+			return device, nil
+		}
+	}
+	return model.Device{}, fmt.Errorf("%w: no active device with label %s", errUnknownDevice, label)
+}
+
+// cacheDevice updates the cache and Home Assistant discovery after the device has changed in the database
+func cacheDevice(device model.Device) {
+	devicesLock.Lock()
+	if device.Status == DeviceStatusActive {
+		devices[deviceKey(device.Mac)] = device
+	} else {
+		delete(devices, deviceKey(device.Mac))
+	}
+	devicesLock.Unlock()
+
+	// The label may have changed, new series are created by the next measurement
+	deleteSensorMetrics(device)
+
+	if device.Status == DeviceStatusActive {
+		trackDevice(device)
+		publishDiscovery(device)
+	} else {
+		untrackDevice(device)
+		removeDiscovery(device)
+	}
+}
+
+// selectDevice returns the device with the given MAC whatever its status is
+func selectDevice(mac string) (model.Device, error) {
+	var device model.Device
+	stmt := SELECT(Device.AllColumns).FROM(Device).WHERE(LOWER(Device.Mac).EQ(String(mac)))
+	err := stmt.Query(db, &device)
+	return device, err
+}
+
+func getDevices(c echo.Context) error {
+	condition := Bool(true)
+	if status := c.QueryParam("status"); status != "" {
+		condition = Device.Status.EQ(String(status))
+	}
+
+	var allDevices []model.Device
+	stmt := SELECT(Device.AllColumns).FROM(Device).WHERE(condition).ORDER_BY(Device.ID)
+	if err := stmt.Query(db, &allDevices); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		log.Error().Err(err).Msg("Failed to select devices")
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+
+	result := []DeviceJson{}
+	for _, device := range allDevices {
+		result = append(result, toDeviceJson(device))
+	}
+	return c.JSON(200, result)
+}
+
+func getDevice(c echo.Context) error {
+	mac, err := normalizeMac(c.Param("mac"))
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+
+	device, err := selectDevice(mac)
+	if errors.Is(err, qrm.ErrNoRows) {
+		return echo.NewHTTPError(404, "Device not found")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to select device %s", mac)
+		return echo.NewHTTPError(500, "Failed to read device")
+	}
+	return c.JSON(200, toDeviceJson(device))
+}
+
+// postDevice registers a new device. A retired device with the same MAC is taken back into use
+// and a pending one is approved without backfilling its readings.
+func postDevice(c echo.Context) error {
+	d := new(DeviceJson)
+	if err := c.Bind(d); err != nil {
+		log.Error().Err(err).Msgf("Failed to bind payload into device")
+		return echo.NewHTTPError(400, "Invalid data")
+	}
+	mac, err := normalizeMac(d.MAC)
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	if strings.TrimSpace(d.Label) == "" {
+		return echo.NewHTTPError(400, "Invalid data: label is required")
+	}
+	if err := loadDevices(); err != nil {
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+
+	device, err := selectDevice(mac)
+	switch {
+	case err == nil && device.Status == DeviceStatusActive:
+		return echo.NewHTTPError(409, fmt.Sprintf("Device %s already exists", mac))
+	case err == nil && device.Status == DeviceStatusPending:
+		device, _, err = approveDevice(device, d.Label, false)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to approve device %s", mac)
+			return echo.NewHTTPError(500, "Failed to write device")
+		}
+		return c.JSON(201, toDeviceJson(device))
+	case err == nil:
+		stmt := Device.UPDATE(Device.Label, Device.Status).
+			SET(String(d.Label), String(DeviceStatusActive)).
+			WHERE(Device.ID.EQ(Int32(device.ID))).
+			RETURNING(Device.AllColumns)
+		err = stmt.Query(db, &device)
+	case errors.Is(err, qrm.ErrNoRows):
+		device = model.Device{Mac: mac, Label: d.Label, Status: DeviceStatusActive}
+		stmt := Device.INSERT(Device.MutableColumns).
+			MODEL(device).
+			ON_CONFLICT().DO_NOTHING().
+			RETURNING(Device.AllColumns)
+		err = stmt.Query(db, &device)
+		if errors.Is(err, qrm.ErrNoRows) {
+			return echo.NewHTTPError(409, fmt.Sprintf("Device %s was registered meanwhile, try again", mac))
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to register device %s", mac)
+		return echo.NewHTTPError(500, "Failed to write device")
+	}
+	log.Info().Msgf("Registered device %s as %s", mac, device.Label)
+
+	cacheDevice(device)
+	return c.JSON(201, toDeviceJson(device))
+}
+
+// patchDevice relabels a device
+func patchDevice(c echo.Context) error {
+	mac, err := normalizeMac(c.Param("mac"))
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	d := new(DeviceJson)
+	if err := c.Bind(d); err != nil {
+		log.Error().Err(err).Msgf("Failed to bind payload into device")
+		return echo.NewHTTPError(400, "Invalid data")
+	}
+	if strings.TrimSpace(d.Label) == "" {
+		return echo.NewHTTPError(400, "Invalid data: label is required")
+	}
+	if err := loadDevices(); err != nil {
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+	previous, previousErr := lookupDevice(mac)
+
+	var device model.Device
+	stmt := Device.UPDATE(Device.Label).
+		SET(String(d.Label)).
+		WHERE(LOWER(Device.Mac).EQ(String(mac))).
+		RETURNING(Device.AllColumns)
+	err = stmt.Query(db, &device)
+	if errors.Is(err, qrm.ErrNoRows) {
+		return echo.NewHTTPError(404, "Device not found")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to relabel device %s", mac)
+		return echo.NewHTTPError(500, "Failed to write device")
+	}
+	log.Info().Msgf("Relabeled device %s as %s", mac, device.Label)
+
+	// Entities are created again so that Home Assistant names them after the new label
+	if previousErr == nil && previous.Label != device.Label {
+		removeDiscovery(previous)
+	}
+	cacheDevice(device)
+	return c.JSON(200, toDeviceJson(device))
+}
+
+// deleteDevice retires a device. Its measurements are kept but new ones are no longer accepted.
+func deleteDevice(c echo.Context) error {
+	mac, err := normalizeMac(c.Param("mac"))
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	if err := loadDevices(); err != nil {
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+
+	var device model.Device
+	stmt := Device.UPDATE(Device.Status).
+		SET(String(DeviceStatusRetired)).
+		WHERE(LOWER(Device.Mac).EQ(String(mac))).
+		RETURNING(Device.AllColumns)
+	err = stmt.Query(db, &device)
+	if errors.Is(err, qrm.ErrNoRows) {
+		return echo.NewHTTPError(404, "Device not found")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to retire device %s", mac)
+		return echo.NewHTTPError(500, "Failed to write device")
+	}
+	log.Info().Msgf("Retired device %s", mac)
+
+	cacheDevice(device)
+	return c.NoContent(204)
+}
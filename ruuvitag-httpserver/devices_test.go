@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+func TestNormalizeMac(t *testing.T) {
+	tests := []struct {
+		mac     string
+		want    string
+		wantErr bool
+	}{
+		{mac: "aa:bb:cc:dd:ee:ff", want: "aa:bb:cc:dd:ee:ff"},
+		{mac: "AA:BB:CC:DD:EE:FF", want: "aa:bb:cc:dd:ee:ff"},
+		{mac: "AA-BB-CC-DD-EE-FF", want: "aa:bb:cc:dd:ee:ff"},
+		{mac: "aabb.ccdd.eeff", want: "aa:bb:cc:dd:ee:ff"},
+		{mac: "AABBCCDDEEFF", want: "aa:bb:cc:dd:ee:ff"},
+		{mac: "aabbccddee", wantErr: true},
+		{mac: "aa:bb:cc:dd:ee:ff:00:11", wantErr: true},
+		{mac: "sauna", wantErr: true},
+		{mac: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mac, func(t *testing.T) {
+			got, err := normalizeMac(tt.mac)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeMac() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeMac() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedDeviceInAnyNotation(t *testing.T) {
+	previousDevices, previousDevicesLoaded := devices, devicesLoaded
+	t.Cleanup(func() { devices, devicesLoaded = previousDevices, previousDevicesLoaded })
+	device := model.Device{ID: 1, Mac: "AA:BB:CC:DD:EE:FF", Label: "sauna", Status: DeviceStatusActive}
+	devices = map[string]model.Device{deviceKey(device.Mac): device}
+	devicesLoaded = true
+
+	for _, mac := range []string{"aa:bb:cc:dd:ee:ff", "AA-BB-CC-DD-EE-FF", "aabbccddeeff", "aabb.ccdd.eeff"} {
+		if found, ok := cachedDevice(mac); !ok || found.ID != device.ID {
+			t.Errorf("cachedDevice(%s) = %v, %t, want the device", mac, found, ok)
+		}
+		if found, err := lookupDevice(mac); err != nil || found.ID != device.ID {
+			t.Errorf("lookupDevice(%s) = %v, %v, want the device", mac, found, err)
+		}
+	}
+	if _, ok := cachedDevice("aa:bb:cc:dd:ee:00"); ok {
+		t.Errorf("cachedDevice() found a device of another MAC")
+	}
+}
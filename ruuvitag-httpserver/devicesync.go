@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+// Keeps the device cache current when devices are changed by another server or directly in SQL. A
+// trigger on device notifies device_changed, see migrations/0009_device_notify.sql. Notifications are
+// lost while the listener reconnects, so the cache is also reloaded after every reconnect and every
+// reload interval. The listener also keeps the token cache of auth.go current the same way.
+
+const (
+	deviceChannel = "device_changed"
+
+	defaultDeviceReloadInterval = 5 * time.Minute
+	listenerMinReconnect        = 10 * time.Second
+	listenerMaxReconnect        = time.Minute
+	listenerPingInterval        = 90 * time.Second
+)
+
+type DevicesConfig struct {
+	// ReloadInterval between full reloads of the device and token caches
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// deviceNotification is the payload of device_changed
+type deviceNotification struct {
+	Op  string `json:"op"`
+	ID  int32  `json:"id"`
+	Mac string `json:"mac"`
+}
+
+func defaultDevicesConfig() DevicesConfig {
+	return DevicesConfig{ReloadInterval: defaultDeviceReloadInterval}
+}
+
+func checkDevicesConfig(c DevicesConfig) error {
+	if c.ReloadInterval <= 0 {
+		return fmt.Errorf("devices reloadInterval must be positive")
+	}
+	return nil
+}
+
+// reloadDevices reads the active devices and applies the differences to the cache
+func reloadDevices() error {
+	stmt := SELECT(Device.AllColumns).FROM(Device).WHERE(Device.Status.EQ(String(DeviceStatusActive)))
+	var activeDevices []model.Device
+	if err := stmt.Query(db, &activeDevices); err != nil {
+		log.Error().Err(err).Msg("Failed to select all devices")
+		return err
+	}
+
+	active := map[int32]bool{}
+	for _, device := range activeDevices {
+		active[device.ID] = true
+		applyDeviceChange(device, false)
+	}
+
+	devicesLock.Lock()
+	gone := []model.Device{}
+	for _, device := range devices {
+		if !active[device.ID] {
+			gone = append(gone, device)
+		}
+	}
+	devicesLoaded = true
+	devicesLock.Unlock()
+
+	for _, device := range gone {
+		applyDeviceChange(device, true)
+	}
+	return nil
+}
+
+// applyDeviceChange brings the cache in line with the device as it is in the database. Devices that are
+// already cached as they are, e.g. changed by this server, are left alone.
+func applyDeviceChange(device model.Device, deleted bool) {
+	devicesLock.RLock()
+	loaded := devicesLoaded
+	var cached model.Device
+	has := false
+	for _, d := range devices {
+		if d.ID == device.ID {
+			cached, has = d, true
+			break
+		}
+	}
+	devicesLock.RUnlock()
+
+	active := device.Status == DeviceStatusActive && !deleted
+	unchanged := has && cached.Mac == device.Mac && cached.Label == device.Label
+	if (has && active && unchanged) || (!has && !active) {
+		return
+	}
+
+	if has {
+		// Entities are created again under a new MAC or label
+		removed := cached
+		removed.Status = DeviceStatusRetired
+		cacheDevice(removed)
+	}
+	if active {
+		cacheDevice(device)
+	}
+	if loaded {
+		log.Info().Msgf("Device %s (%s) changed in the database, status %s", device.Mac, device.Label, device.Status)
+	}
+}
+
+// applyDeviceNotification reads the device of a notification and applies it to the cache
+func applyDeviceNotification(payload string) error {
+	var n deviceNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return err
+	}
+	if n.Op == "DELETE" {
+		applyDeviceChange(model.Device{ID: n.ID, Mac: n.Mac}, true)
+		return nil
+	}
+
+	var device model.Device
+	stmt := SELECT(Device.AllColumns).FROM(Device).WHERE(Device.ID.EQ(Int32(n.ID)))
+	err := stmt.Query(db, &device)
+	if errors.Is(err, qrm.ErrNoRows) {
+		// Deleted again before it was read
+		applyDeviceChange(model.Device{ID: n.ID, Mac: n.Mac}, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	applyDeviceChange(device, false)
+	return nil
+}
+
+// syncDevices listens to device and token changes and reloads the caches every reload interval
+func syncDevices() {
+	listener := pq.NewListener(envFile["POSTGRESQL_CONN_URL"], listenerMinReconnect, listenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Error().Err(err).Msgf("Device listener event %d", event)
+			}
+		})
+	defer listener.Close()
+	for _, channel := range []string{deviceChannel, tokenChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Error().Err(err).Msgf("Failed to listen to %s, relying on reloads", channel)
+		}
+	}
+
+	reload := time.NewTicker(config.Devices.ReloadInterval)
+	defer reload.Stop()
+	ping := time.NewTicker(listenerPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case n := <-listener.Notify:
+			// nil after a reconnect, changes in between were missed
+			if n == nil {
+				log.Info().Msg("Device listener reconnected, reloading devices and tokens")
+				reloadDevices()
+				reloadTokens()
+				continue
+			}
+			if n.Channel == tokenChannel {
+				reloadTokens()
+				continue
+			}
+			if err := applyDeviceNotification(n.Extra); err != nil {
+				log.Error().Err(err).Msgf("Failed to apply device notification %s", strings.TrimSpace(n.Extra))
+			}
+		case <-reload.C:
+			reloadDevices()
+			reloadTokens()
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Stale devices and gaps. The availability watchdog reports a device stale once it has been silent for
+// stale.after: it goes offline in MQTT, a gap is opened in sensor_gap from its last reading, and the built
+// in stale alert fires. The first reading after the silence closes the gap and resolves the alert.
+// Silence while the server is down is recorded from the last stored reading of the device. Gaps and stale
+// alerts are written by a worker of their own, so that the watchdog never waits for the database.
+
+const (
+	staleAlertRule  = "stale"
+	staleAlertField = "silence"
+
+	defaultGapPeriod = 7 * 24 * time.Hour
+	maxUptimeDays    = 366
+	gapQueueSize     = 256
+)
+
+type StaleConfig struct {
+	// After is how long a device may stay silent before it is stale. SENSOR_OFFLINE_AFTER in .env overrides it.
+	After time.Duration `yaml:"after"`
+	// Alert enables the stale alert rule
+	Alert  bool     `yaml:"alert"`
+	Notify []string `yaml:"notify"`
+}
+
+type GapJson struct {
+	MAC       string     `json:"mac"`
+	Label     string     `json:"label"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt"`
+	// DurationSeconds up to now for a gap that has not ended
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// UptimeJson is the coverage of a device on a UTC day
+type UptimeJson struct {
+	MAC   string `json:"mac"`
+	Label string `json:"label"`
+	Date  string `json:"date"`
+	// Coverage is the percentage of the day, up to to or now on the last day, that was not in a gap
+	Coverage   float64 `json:"coverage"`
+	GapSeconds float64 `json:"gapSeconds"`
+	Gaps       int     `json:"gaps"`
+}
+
+type deviceGap struct {
+	model.SensorGap
+	Device model.Device
+}
+
+// gapEvent is a device that went stale after its last reading at, or reported again at
+type gapEvent struct {
+	device model.Device
+	at     time.Time
+	stale  bool
+}
+
+var (
+	gapQueue = make(chan gapEvent, gapQueueSize)
+	// staleAlerts by device ID, only used by runGaps
+	staleAlerts = map[int32]*alertState{}
+)
+
+func defaultStaleConfig() StaleConfig {
+	return StaleConfig{After: defaultOfflineAfter, Alert: true}
+}
+
+func checkStaleConfig(c StaleConfig, alerts AlertsConfig) error {
+	if c.After <= 0 {
+		return fmt.Errorf("stale after must be positive")
+	}
+	for _, rule := range alerts.Rules {
+		if rule.Name == staleAlertRule {
+			return fmt.Errorf("alert rule %s is built in", staleAlertRule)
+		}
+	}
+	notifiers := map[string]bool{}
+	for _, n := range alerts.Notifiers {
+		notifiers[n.Name] = true
+	}
+	for _, name := range c.Notify {
+		if !notifiers[name] {
+			return fmt.Errorf("stale: unknown notifier %s", name)
+		}
+	}
+	return nil
+}
+
+// staleRule is the built in stale alert rule, its values are seconds of silence
+func staleRule() AlertRule {
+	after := offlineAfter.Seconds()
+	return AlertRule{Name: staleAlertRule, Field: staleAlertField, Above: &after, Notify: config.Stale.Notify}
+}
+
+// loadStaleAlerts takes over the stale alerts that were firing before a restart
+func loadStaleAlerts() error {
+	var firing []model.Alert
+	stmt := SELECT(Alert.AllColumns).
+		FROM(Alert).
+		WHERE(Alert.Status.EQ(String(AlertStatusFiring)).AND(Alert.Rule.EQ(String(staleAlertRule))))
+	if err := stmt.Query(db, &firing); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		return err
+	}
+	for i := range firing {
+		staleAlerts[firing[i].DeviceID] = &alertState{firing: &firing[i]}
+	}
+	return nil
+}
+
+// queueGapEvent queues the event for runGaps
+func queueGapEvent(event gapEvent) {
+	select {
+	case gapQueue <- event:
+	default:
+		log.Error().Msgf("Gap queue is full, not recording gap of %s", event.device.Mac)
+	}
+}
+
+// runGaps opens and closes the gaps of the queued events in order
+func runGaps() {
+	if err := loadStaleAlerts(); err != nil {
+		log.Error().Err(err).Msg("Failed to load stale alerts, they fire again")
+	}
+	for event := range gapQueue {
+		if event.stale {
+			markStale(event.device, event.at)
+		} else {
+			markReturned(event.device, event.at)
+		}
+	}
+}
+
+// markStale opens a gap from the last reading of the device and fires the stale alert
+func markStale(device model.Device, lastSeen time.Time) {
+	insertStmt := SensorGap.INSERT(SensorGap.DeviceID, SensorGap.StartedAt).
+		VALUES(device.ID, lastSeen).
+		ON_CONFLICT(SensorGap.DeviceID).WHERE(SensorGap.EndedAt.IS_NULL()).DO_NOTHING()
+	if _, err := insertStmt.Exec(db); err != nil {
+		log.Error().Err(err).Msgf("Failed to open gap of %s", device.Mac)
+	}
+
+	if !config.Stale.Alert {
+		return
+	}
+	state, ok := staleAlerts[device.ID]
+	if !ok {
+		state = &alertState{}
+		staleAlerts[device.ID] = state
+	}
+	if state.firing == nil {
+		fireAlert(staleRule(), device, state, time.Since(lastSeen).Round(time.Second).Seconds(), lastSeen)
+	}
+}
+
+// markReturned closes the open gap of the device, if any, and resolves its stale alert
+func markReturned(device model.Device, at time.Time) {
+	updateStmt := SensorGap.UPDATE(SensorGap.EndedAt).
+		SET(TimestampzT(at)).
+		WHERE(SensorGap.DeviceID.EQ(Int32(device.ID)).AND(SensorGap.EndedAt.IS_NULL()))
+	result, err := updateStmt.Exec(db)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to close gap of %s", device.Mac)
+	} else if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Info().Msgf("Device %s reported again, closed its gap", device.Label)
+	}
+
+	if state, ok := staleAlerts[device.ID]; ok && state.firing != nil {
+		silence := at.Sub(state.firing.StartedAt).Round(time.Second).Seconds()
+		resolveAlert(staleRule(), device, state, silence, at)
+	}
+}
+
+// parseGapPeriod reads from and to, the last week by default
+func parseGapPeriod(c echo.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	var err error
+	if value := c.QueryParam("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			return to, to, fmt.Errorf("invalid to: %s", value)
+		}
+	}
+	from := to.Add(-defaultGapPeriod)
+	if value := c.QueryParam("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			return from, to, fmt.Errorf("invalid from: %s", value)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// selectGaps returns the gaps that overlap the period, of the device given by MAC or label or of all devices
+func selectGaps(device string, from time.Time, to time.Time) ([]deviceGap, error) {
+	condition := SensorGap.StartedAt.LT(TimestampzT(to)).
+		AND(SensorGap.EndedAt.IS_NULL().OR(SensorGap.EndedAt.GT(TimestampzT(from))))
+	if device != "" {
+		if mac, err := normalizeMac(device); err == nil {
+			condition = condition.AND(LOWER(Device.Mac).EQ(String(mac)))
+		} else {
+			condition = condition.AND(Device.Label.EQ(String(device)))
+		}
+	}
+
+	var gaps []deviceGap
+	stmt := SELECT(SensorGap.AllColumns, Device.AllColumns).
+		FROM(SensorGap.INNER_JOIN(Device, Device.ID.EQ(SensorGap.DeviceID))).
+		WHERE(condition).
+		ORDER_BY(SensorGap.StartedAt.DESC())
+	if err := stmt.Query(db, &gaps); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		return nil, err
+	}
+	return gaps, nil
+}
+
+// gapOverlap returns how much of the gap is between from and to, open gaps last until now
+func gapOverlap(gap model.SensorGap, from time.Time, to time.Time, now time.Time) time.Duration {
+	end := now
+	if gap.EndedAt != nil {
+		end = *gap.EndedAt
+	}
+	if gap.StartedAt.After(from) {
+		from = gap.StartedAt
+	}
+	if end.Before(to) {
+		to = end
+	}
+	return max(to.Sub(from), 0)
+}
+
+// getGaps lists the gaps of the last week, or from and to, optionally of one device
+func getGaps(c echo.Context) error {
+	from, to, err := parseGapPeriod(c)
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	gaps, err := selectGaps(c.QueryParam("device"), from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to select gaps")
+		return echo.NewHTTPError(500, "Failed to read gaps")
+	}
+
+	now := time.Now()
+	result := []GapJson{}
+	for _, gap := range gaps {
+		end := now
+		if gap.EndedAt != nil {
+			end = *gap.EndedAt
+		}
+		result = append(result, GapJson{
+			MAC:             gap.Device.Mac,
+			Label:           gap.Device.Label,
+			StartedAt:       gap.StartedAt,
+			EndedAt:         gap.EndedAt,
+			DurationSeconds: end.Sub(gap.StartedAt).Round(time.Second).Seconds(),
+		})
+	}
+	return c.JSON(200, result)
+}
+
+// deviceStarts returns when each device started reporting: its first seen time, or else the day of its
+// first daily rollup. Devices without either are left out.
+func deviceStarts(selected []model.Device) (map[int32]time.Time, error) {
+	var firstDays []struct {
+		DeviceID int32
+		Start    time.Time
+	}
+	stmt := SELECT(MeasurementDaily.DeviceID.AS("device_id"), MIN(MeasurementDaily.CreatedAt).AS("start")).
+		FROM(MeasurementDaily).
+		GROUP_BY(MeasurementDaily.DeviceID)
+	if err := stmt.Query(db, &firstDays); err != nil && !errors.Is(err, qrm.ErrNoRows) {
+		return nil, err
+	}
+
+	starts := map[int32]time.Time{}
+	for _, day := range firstDays {
+		starts[day.DeviceID] = day.Start
+	}
+	for _, d := range selected {
+		if start, ok := starts[d.ID]; d.FirstSeen != nil && (!ok || d.FirstSeen.Before(start)) {
+			starts[d.ID] = *d.FirstSeen
+		}
+	}
+	return starts, nil
+}
+
+// getUptime returns the coverage of every active device, or of the given one, per UTC day of the last
+// week or from and to. Days before a device started reporting are left out, and the day it started is
+// covered from then on.
+func getUptime(c echo.Context) error {
+	from, to, err := parseGapPeriod(c)
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	from = from.UTC().Truncate(24 * time.Hour)
+	if to.Sub(from) > maxUptimeDays*24*time.Hour {
+		return echo.NewHTTPError(400, fmt.Sprintf("period is limited to %d days", maxUptimeDays))
+	}
+
+	device := c.QueryParam("device")
+	gaps, err := selectGaps(device, from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to select gaps")
+		return echo.NewHTTPError(500, "Failed to read gaps")
+	}
+	if err := loadDevices(); err != nil {
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+
+	devicesLock.RLock()
+	selected := []model.Device{}
+	for _, d := range devices {
+		if device == "" || d.Label == device || normalizedMacEquals(device, d.Mac) {
+			selected = append(selected, d)
+		}
+	}
+	devicesLock.RUnlock()
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Label < selected[j].Label })
+	starts, err := deviceStarts(selected)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to select device starts")
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+
+	now := time.Now()
+	result := []UptimeJson{}
+	for _, d := range selected {
+		started, ok := starts[d.ID]
+		if !ok {
+			continue
+		}
+		for day := from; day.Before(to) && day.Before(now); day = day.Add(24 * time.Hour) {
+			if uptime, ok := dayUptime(d, day, started, gaps, to, now); ok {
+				result = append(result, uptime)
+			}
+		}
+	}
+	return c.JSON(200, result)
+}
+
+// dayUptime returns the coverage of the device on the day, from when it started reporting up to the end of
+// the day, to or now, whichever comes first. ok is false when the device had not started by then.
+func dayUptime(d model.Device, day time.Time, started time.Time, gaps []deviceGap, to time.Time, now time.Time) (UptimeJson, bool) {
+	end := day.Add(24 * time.Hour)
+	if end.After(to) {
+		end = to
+	}
+	if end.After(now) {
+		end = now
+	}
+	if !end.After(started) {
+		return UptimeJson{}, false
+	}
+	uptime := UptimeJson{MAC: d.Mac, Label: d.Label, Date: day.Format(time.DateOnly)}
+	start := day
+	if started.After(start) {
+		start = started
+	}
+	var silent time.Duration
+	for _, gap := range gaps {
+		if gap.DeviceID != d.ID {
+			continue
+		}
+		if overlap := gapOverlap(gap.SensorGap, start, end, now); overlap > 0 {
+			silent += overlap
+			uptime.Gaps++
+		}
+	}
+	uptime.GapSeconds = silent.Round(time.Second).Seconds()
+	uptime.Coverage = math.Round(10000*(1-silent.Seconds()/end.Sub(start).Seconds())) / 100
+	return uptime, true
+}
+
+// normalizedMacEquals is whether value is the MAC address mac in any notation
+func normalizedMacEquals(value string, mac string) bool {
+	normalized, err := normalizeMac(value)
+	return err == nil && normalized == strings.ToLower(mac)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+func TestDayUptime(t *testing.T) {
+	device := model.Device{ID: 1, Mac: "aa:bb:cc:dd:ee:01", Label: "sauna"}
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	at := func(hours float64) time.Time { return day.Add(time.Duration(hours * float64(time.Hour))) }
+	gap := func(from float64, to float64) deviceGap {
+		ended := at(to)
+		return deviceGap{SensorGap: model.SensorGap{DeviceID: device.ID, StartedAt: at(from), EndedAt: &ended}}
+	}
+	later := day.AddDate(0, 0, 7)
+
+	tests := []struct {
+		name         string
+		started      time.Time
+		gaps         []deviceGap
+		to           time.Time
+		now          time.Time
+		wantOk       bool
+		wantCoverage float64
+		wantGaps     int
+	}{
+		{name: "whole day", started: day.AddDate(0, 0, -1), to: later, now: later, wantOk: true, wantCoverage: 100},
+		{name: "gap of a quarter", started: day.AddDate(0, 0, -1), gaps: []deviceGap{gap(6, 12)}, to: later, now: later,
+			wantOk: true, wantCoverage: 75, wantGaps: 1},
+		{name: "up to now on today", started: day.AddDate(0, 0, -1), gaps: []deviceGap{gap(0, 3)}, to: later, now: at(12),
+			wantOk: true, wantCoverage: 75, wantGaps: 1},
+		{name: "up to to on the last day", started: day.AddDate(0, 0, -1), gaps: []deviceGap{gap(0, 3)}, to: at(12), now: later,
+			wantOk: true, wantCoverage: 75, wantGaps: 1},
+		{name: "gaps after to are left out", started: day.AddDate(0, 0, -1), gaps: []deviceGap{gap(13, 14)}, to: at(12), now: later,
+			wantOk: true, wantCoverage: 100},
+		{name: "from the start", started: at(12), gaps: []deviceGap{gap(18, 21)}, to: later, now: later,
+			wantOk: true, wantCoverage: 75, wantGaps: 1},
+		{name: "not started yet", started: at(13), to: at(12), now: later},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := dayUptime(device, day, tt.started, tt.gaps, tt.to, tt.now)
+			if ok != tt.wantOk {
+				t.Fatalf("dayUptime() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if got.Coverage != tt.wantCoverage || got.Gaps != tt.wantGaps {
+				t.Errorf("dayUptime() coverage = %g with %d gaps, want %g with %d", got.Coverage, got.Gaps, tt.wantCoverage, tt.wantGaps)
+			}
+		})
+	}
+}
+
+func TestTrackDeviceFromLastReading(t *testing.T) {
+	previousAvailabilities, previousReadings := availabilities, lastReadings
+	t.Cleanup(func() { availabilities, lastReadings = previousAvailabilities, previousReadings })
+	availabilities = map[string]*deviceAvailability{}
+	silentSince := time.Now().Add(-2 * time.Hour)
+	lastReadings = map[int32]time.Time{1: silentSince}
+
+	trackDevice(model.Device{ID: 1, Mac: "AA:BB:CC:DD:EE:01"})
+	trackDevice(model.Device{ID: 2, Mac: "aa:bb:cc:dd:ee:02"})
+
+	if got := availabilities["aa:bb:cc:dd:ee:01"].lastSeen; !got.Equal(silentSince) {
+		t.Errorf("lastSeen of a device with a stored reading = %s, want %s", got, silentSince)
+	}
+	if got := availabilities["aa:bb:cc:dd:ee:02"].lastSeen; time.Since(got) > time.Minute {
+		t.Errorf("lastSeen of a new device = %s, want now for a grace period", got)
+	}
+}
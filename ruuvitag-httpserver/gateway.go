@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// HTTP push of the official Ruuvi Gateway
+// https://docs.ruuvi.com/gw-data-formats/http-time-stamped-data-from-bluetooth-sensors
+
+// RuuviGatewayJson is the document the gateway posts, all tags seen since the previous push
+type RuuviGatewayJson struct {
+	Data struct {
+		Coordinates string                     `json:"coordinates"`
+		Timestamp   gatewayTimestamp           `json:"timestamp"`
+		GatewayMac  string                     `json:"gw_mac"`
+		Tags        map[string]RuuviGatewayTag `json:"tags"`
+	} `json:"data"`
+}
+
+type RuuviGatewayTag struct {
+	Rssi      *int32           `json:"rssi"`
+	Timestamp gatewayTimestamp `json:"timestamp"`
+	// Data is the raw advertisement as a hex string
+	Data string `json:"data"`
+}
+
+// gatewayTimestamp is Unix time in seconds. Gateway firmware sends it either as a string or as a number.
+type gatewayTimestamp int64
+
+func (t *gatewayTimestamp) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		*t = 0
+		return nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s: %w", data, err)
+	}
+	*t = gatewayTimestamp(seconds)
+	return nil
+}
+
+func (t gatewayTimestamp) time() *time.Time {
+	if t <= 0 {
+		return nil
+	}
+	timestamp := time.Unix(int64(t), 0)
+	return &timestamp
+}
+
+// decodeGatewayTag decodes the advertisement of a single tag. The MAC given by the gateway is preferred
+// over the one in the data, since data format 3 does not carry it.
+func decodeGatewayTag(mac string, tag RuuviGatewayTag, gatewayMac string) (*MeasurementJson, error) {
+	advertisement, err := hex.DecodeString(tag.Data)
+	if err != nil {
+		return nil, fmt.Errorf("data is not hex: %w", err)
+	}
+	m, err := decodeAdvertisement(advertisement)
+	if err != nil {
+		return nil, err
+	}
+
+	if mac != "" {
+		m.MAC = mac
+	}
+	m.Rssi = tag.Rssi
+	m.Timestamp = tag.Timestamp.time()
+	if normalized, err := normalizeMac(gatewayMac); err == nil {
+		gatewayMac = normalized
+	}
+	if gatewayMac != "" {
+		m.Gateway = &gatewayMac
+	}
+	return m, nil
+}
+
+// postGatewayMeasurements stores the tags of a Ruuvi Gateway push as one batch. Tags that cannot be
+// decoded are reported as failed, the gateway itself only looks at the status code.
+func postGatewayMeasurements(c echo.Context) error {
+	g := new(RuuviGatewayJson)
+	if err := json.NewDecoder(c.Request().Body).Decode(g); err != nil {
+		log.Error().Err(err).Msgf("Failed to bind payload into gateway data")
+		countRejected(RejectReasonInvalidPayload)
+		return echo.NewHTTPError(400, "Invalid data")
+	}
+	if len(g.Data.Tags) > maxBatchSize {
+		return echo.NewHTTPError(400, fmt.Sprintf("Invalid data: batch size is limited to %d", maxBatchSize))
+	}
+
+	gatewayMac := g.Data.GatewayMac
+	if gatewayMac == "" && requestIdentity(c) != nil {
+		gatewayMac = *requestIdentity(c)
+	}
+
+	macs := make([]string, 0, len(g.Data.Tags))
+	for mac := range g.Data.Tags {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	batch := []*MeasurementJson{}
+	failed := []MeasurementResult{}
+	for _, mac := range macs {
+		m, err := decodeGatewayTag(mac, g.Data.Tags[mac], gatewayMac)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to decode data of %s from gateway %s", mac, gatewayMac)
+			countRejected(RejectReasonInvalidData)
+			failed = append(failed, MeasurementResult{MAC: mac, Status: MeasurementStatusFailed, Error: err.Error()})
+			continue
+		}
+		batch = append(batch, m)
+	}
+	log.Info().Msgf("Received %d measurements from gateway %s", len(batch), gatewayMac)
+
+	results, err := storeMeasurementBatch(batch)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to write gateway data")
+		return echo.NewHTTPError(500, "Failed to write data")
+	}
+	for _, result := range failed {
+		result.Index = len(results)
+		results = append(results, result)
+	}
+
+	return c.JSON(200, results)
+}
@@ -0,0 +1,16 @@
+#!/bin/sh
+# Regenerates the go-jet models in .gen from the schema of the database in POSTGRESQL_CONN_URL.
+# Add a migration to migrations/ first, then run this against a database named ruuvi.
+set -e
+cd "$(dirname "$0")"
+
+if [ -z "$POSTGRESQL_CONN_URL" ] && [ -f .env ]; then
+    POSTGRESQL_CONN_URL=$(sed -n 's/^POSTGRESQL_CONN_URL=//p' .env)
+fi
+if [ -z "$POSTGRESQL_CONN_URL" ]; then
+    echo "POSTGRESQL_CONN_URL is not set" >&2
+    exit 1
+fi
+
+go run . migrate
+go run github.com/go-jet/jet/v2/cmd/jet@v2.13.0 -dsn="$POSTGRESQL_CONN_URL" -schema=public -path=./.gen -ignore-tables=schema_migration
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+// Home Assistant MQTT discovery, see https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+
+const homeAssistantStatusTopic = "homeassistant/status"
+
+// publishMqtt publishes with QoS 0 and waits a moment for the publish to complete
+func publishMqtt(topic string, retained bool, payload []byte) bool {
+	start := time.Now()
+	token := mqttClient.Publish(topic, 0, retained, payload)
+	published := token.WaitTimeout(500 * time.Millisecond)
+	mqttPublishDuration.WithLabelValues(strconv.FormatBool(published)).Observe(time.Since(start).Seconds())
+	return published
+}
+
+func mqttSensorMac(device model.Device) string {
+	return strings.ReplaceAll(strings.ToLower(device.Mac), ":", "_")
+}
+
+// discoveryEntity describes one Home Assistant sensor of a tag. All sensors read the same state payload.
+type discoveryEntity struct {
+	key            string
+	name           string
+	unit           string
+	deviceClass    string
+	stateClass     string
+	entityCategory string
+	valueTemplate  string
+}
+
+var discoveryEntities = []discoveryEntity{
+	// Temperature has no name of its own so that it shows with the label, as it did before the other entities
+	{key: "temperature", unit: "°C", deviceClass: "temperature", stateClass: "measurement",
+		valueTemplate: "{{ value_json.temp }}"},
+	{key: "humidity", name: "Humidity", unit: "%", deviceClass: "humidity", stateClass: "measurement",
+		valueTemplate: "{{ value_json.humidity }}"},
+	{key: "pressure", name: "Pressure", unit: "hPa", deviceClass: "atmospheric_pressure", stateClass: "measurement",
+		valueTemplate: "{{ value_json.pressure / 100 if value_json.pressure is not none else none }}"},
+	{key: "battery_voltage", name: "Battery voltage", unit: "V", deviceClass: "voltage", stateClass: "measurement", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.battery / 1000 if value_json.battery is not none else none }}"},
+	{key: "battery_compensated", name: "Battery voltage compensated", unit: "V", deviceClass: "voltage", stateClass: "measurement", entityCategory: "diagnostic",
+		valueTemplate: "{{ (value_json.batteryCompensated / 1000) | round(3) if value_json.batteryCompensated is not none else none }}"},
+	{key: "battery_replace_at", name: "Battery replacement", deviceClass: "timestamp", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.batteryReplaceAt if value_json.batteryReplaceAt is not none else none }}"},
+	{key: "rssi", name: "Signal strength", unit: "dBm", deviceClass: "signal_strength", stateClass: "measurement", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.rssi }}"},
+	{key: "movement_counter", name: "Movement counter", stateClass: "total_increasing", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.movementCounter }}"},
+	{key: "acceleration_x", name: "Acceleration X", unit: "g", stateClass: "measurement", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.accelerationX / 1000 if value_json.accelerationX is not none else none }}"},
+	{key: "acceleration_y", name: "Acceleration Y", unit: "g", stateClass: "measurement", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.accelerationY / 1000 if value_json.accelerationY is not none else none }}"},
+	{key: "acceleration_z", name: "Acceleration Z", unit: "g", stateClass: "measurement", entityCategory: "diagnostic",
+		valueTemplate: "{{ value_json.accelerationZ / 1000 if value_json.accelerationZ is not none else none }}"},
+}
+
+func discoveryTopic(device model.Device, entity discoveryEntity) string {
+	return fmt.Sprintf("homeassistant/sensor/%s_%s/config", mqttSensorMac(device), entity.key)
+}
+
+func stateTopic(device model.Device) string {
+	return fmt.Sprintf("home/temperature/%s", mqttSensorMac(device))
+}
+
+// discoveryDevice groups the entities of a tag under one Home Assistant device
+func discoveryDevice(device model.Device) map[string]any {
+	return map[string]any{
+		"identifiers":    []string{fmt.Sprintf("ruuvitag_%s", mqttSensorMac(device))},
+		"connections":    [][]string{{"mac", strings.ToLower(device.Mac)}},
+		"name":           device.Label,
+		"manufacturer":   "Ruuvi Innovations",
+		"model":          "RuuviTag",
+		"suggested_area": device.Label,
+	}
+}
+
+func publishDiscovery(device model.Device) {
+	for _, entity := range discoveryEntities {
+		payload := map[string]any{
+			"name":           nil,
+			"unique_id":      fmt.Sprintf("%s_%s", mqttSensorMac(device), entity.key),
+			"state_topic":    stateTopic(device),
+			"value_template": entity.valueTemplate,
+			"device":         discoveryDevice(device),
+			// The sensor is available only when both the server and the tag are
+			"availability": []map[string]string{
+				{"topic": serverAvailabilityTopic},
+				{"topic": deviceAvailabilityTopic(device)},
+			},
+			"availability_mode": "all",
+		}
+		if entity.name != "" {
+			payload["name"] = entity.name
+		}
+		if entity.unit != "" {
+			payload["unit_of_measurement"] = entity.unit
+		}
+		if entity.deviceClass != "" {
+			payload["device_class"] = entity.deviceClass
+		}
+		if entity.stateClass != "" {
+			payload["state_class"] = entity.stateClass
+		}
+		if entity.entityCategory != "" {
+			payload["entity_category"] = entity.entityCategory
+		}
+
+		data, _ := json.Marshal(payload)
+		publishMqtt(discoveryTopic(device, entity), true, data)
+	}
+	log.Printf("Published discovery for %s", mqttSensorMac(device))
+}
+
+// subscribeHomeAssistantStatus re-publishes discovery whenever Home Assistant comes online,
+// as it forgets the entities that are not retained on the broker
+func subscribeHomeAssistantStatus(client mqtt.Client) {
+	token := client.Subscribe(homeAssistantStatusTopic, 1, func(_ mqtt.Client, message mqtt.Message) {
+		if string(message.Payload()) != payloadOnline {
+			return
+		}
+		log.Info().Msg("Home Assistant came online, re-publishing discovery")
+		// Publishing waits for completion, which must not happen in the message handler
+		go republishDiscovery()
+	})
+	if token.WaitTimeout(2*time.Second) && token.Error() == nil {
+		log.Info().Msgf("Subscribed to %s", homeAssistantStatusTopic)
+	} else {
+		log.Error().Err(token.Error()).Msgf("Failed to subscribe to %s", homeAssistantStatusTopic)
+	}
+}
+
+// republishDiscovery publishes discovery and the last known state of every active device
+func republishDiscovery() {
+	devicesLock.RLock()
+	activeDevices := []model.Device{}
+	for _, device := range devices {
+		activeDevices = append(activeDevices, device)
+	}
+	devicesLock.RUnlock()
+
+	for _, device := range activeDevices {
+		publishDiscovery(device)
+		if sm, ok := hub.last(device.Mac); ok {
+			publishState(device, &sm.MeasurementJson)
+		}
+	}
+}
+
+// removeDiscovery removes the entities of the device from Home Assistant with an empty retained config
+func removeDiscovery(device model.Device) {
+	for _, entity := range discoveryEntities {
+		publishMqtt(discoveryTopic(device, entity), true, []byte{})
+	}
+	log.Printf("Removed discovery for %s", mqttSensorMac(device))
+}
+
+func publishState(device model.Device, m *MeasurementJson) {
+	room := device.Label
+	battery := batteryHealth(device)
+
+	payload := map[string]any{
+		"room":                      room,
+		"temp":                      m.Temperature,
+		"humidity":                  m.Humidity,
+		"pressure":                  m.Pressure,
+		"accelerationX":             m.AccelerationX,
+		"accelerationY":             m.AccelerationY,
+		"accelerationZ":             m.AccelerationZ,
+		"battery":                   m.Battery,
+		"txPower":                   m.TxPower,
+		"movementCounter":           m.MovementCounter,
+		"measurementSequenceNumber": m.MeasurementSequenceNumber,
+		"rssi":                      m.Rssi,
+		"batteryCompensated":        battery.Compensated,
+		"batteryReplaceAt":          battery.ReplaceAt,
+	}
+	data, _ := json.Marshal(payload)
+
+	published := publishMqtt(stateTopic(device), false, data)
+	if published && m.Temperature != nil {
+		log.Info().Msgf("Published state %.2f°C for %s", *m.Temperature, room)
+	} else if published {
+		log.Info().Msgf("Published state for %s", room)
+	} else {
+		log.Error().Msgf("Failed to publish state for %s", m.MAC)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+// InfluxDB storage in line protocol. Org and bucket write to the InfluxDB 2 API, a database to the
+// InfluxDB 1 API. Measurements are written as they are, InfluxDB keeps the last of points with the same
+// time and tags.
+
+const (
+	defaultInfluxMeasurement = "ruuvi"
+	defaultInfluxTokenEnv    = "INFLUXDB_TOKEN"
+	influxWriteTimeout       = 10 * time.Second
+)
+
+type influxStore struct {
+	writeURL    string
+	token       string
+	measurement string
+	client      *http.Client
+}
+
+func newInfluxStore(c BackendConfig) *influxStore {
+	s := &influxStore{
+		measurement: c.Measurement,
+		client:      &http.Client{Timeout: influxWriteTimeout},
+	}
+	if s.measurement == "" {
+		s.measurement = defaultInfluxMeasurement
+	}
+	tokenEnv := c.TokenEnv
+	if tokenEnv == "" {
+		tokenEnv = defaultInfluxTokenEnv
+	}
+	s.token = envFile[tokenEnv]
+
+	query := url.Values{"precision": {"ms"}}
+	base := strings.TrimSuffix(c.URL, "/")
+	if c.Bucket != "" {
+		query.Set("org", c.Org)
+		query.Set("bucket", c.Bucket)
+		s.writeURL = base + "/api/v2/write?" + query.Encode()
+	} else {
+		query.Set("db", c.Database)
+		s.writeURL = base + "/write?" + query.Encode()
+	}
+	return s
+}
+
+// influxEscape escapes measurement names and tag keys and values
+var influxEscape = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxLine returns the measurement in line protocol, false when it has no fields to write
+func (s *influxStore) influxLine(device model.Device, m *MeasurementJson) (string, bool) {
+	var line strings.Builder
+	line.WriteString(influxEscape.Replace(s.measurement))
+	line.WriteString(",mac=" + influxEscape.Replace(device.Mac))
+	if device.Label != "" {
+		line.WriteString(",label=" + influxEscape.Replace(device.Label))
+	}
+	if m.Gateway != nil && *m.Gateway != "" {
+		line.WriteString(",gateway=" + influxEscape.Replace(*m.Gateway))
+	}
+
+	fields := []string{}
+	addFloat := func(key string, value *float64) {
+		if value != nil {
+			fields = append(fields, key+"="+strconv.FormatFloat(*value, 'f', -1, 64))
+		}
+	}
+	addInt32 := func(key string, value *int32) {
+		if value != nil {
+			fields = append(fields, key+"="+strconv.FormatInt(int64(*value), 10)+"i")
+		}
+	}
+	addInt64 := func(key string, value *int64) {
+		if value != nil {
+			fields = append(fields, key+"="+strconv.FormatInt(*value, 10)+"i")
+		}
+	}
+	addFloat("temperature", m.Temperature)
+	addFloat("humidity", m.Humidity)
+	addInt32("pressure", m.Pressure)
+	addInt32("acceleration_x", m.AccelerationX)
+	addInt32("acceleration_y", m.AccelerationY)
+	addInt32("acceleration_z", m.AccelerationZ)
+	addInt32("battery_voltage", m.Battery)
+	addInt32("tx_power", m.TxPower)
+	addInt64("movement_counter", m.MovementCounter)
+	addInt64("measurement_sequence_number", m.MeasurementSequenceNumber)
+	addInt32("rssi", m.Rssi)
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	createdAt := time.Now()
+	if m.Timestamp != nil {
+		createdAt = *m.Timestamp
+	}
+	line.WriteString(" " + strings.Join(fields, ",") + " " + strconv.FormatInt(createdAt.UnixMilli(), 10))
+	return line.String(), true
+}
+
+func (s *influxStore) Write(device model.Device, m *MeasurementJson) (bool, error) {
+	line, ok := s.influxLine(device, m)
+	if !ok {
+		return false, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.writeURL, strings.NewReader(line+"\n"))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	// InfluxDB 1.8 takes username:password as the token
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("influxdb responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return true, nil
+}
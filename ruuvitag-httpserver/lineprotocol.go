@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// InfluxDB compatible write endpoints, POST /write (InfluxDB 1) and POST /api/v2/write (InfluxDB 2), for
+// tools that speak line protocol such as Telegraf and Home Assistant. Points are mapped onto devices by
+// their tags and onto measurement fields by their field names, see LineProtocolConfig. Fields of the same
+// device and time are merged into one measurement. Points that do not name a device, or name one by a label
+// that no active device has, are ignored, so that a Telegraf sending everything it collects does not fail.
+//
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+
+// LineProtocolConfig maps points onto devices and measurement fields
+type LineProtocolConfig struct {
+	// Measurements are the measurement names that are accepted, all when empty
+	Measurements []string `yaml:"measurements"`
+	// MacTags are tags that hold the MAC of the device, the first one that a point has is used
+	MacTags []string `yaml:"macTags"`
+	// LabelTags are tags that hold the label of an active device, used when there is no MAC tag
+	LabelTags []string `yaml:"labelTags"`
+	// Devices map a tag to a device by MAC or label, keyed by <tag>=<value>. They take precedence over
+	// the MAC and label tags. Points whose tags map to different devices are rejected.
+	Devices map[string]string `yaml:"devices"`
+	// Fields map <field> or <measurement>.<field> onto a measurement field, the latter takes precedence.
+	// Fields that are not mapped are ignored.
+	Fields map[string]FieldMapping `yaml:"fields"`
+}
+
+// FieldMapping is the measurement field that a line protocol field is stored as, given as just the name
+// or with a scale that the value is multiplied with, e.g. 100 for hPa
+type FieldMapping struct {
+	Field string  `yaml:"field"`
+	Scale float64 `yaml:"scale"`
+}
+
+func (f *FieldMapping) UnmarshalYAML(unmarshal func(any) error) error {
+	var field string
+	if err := unmarshal(&field); err == nil {
+		*f = FieldMapping{Field: field}
+		return nil
+	}
+	type plain FieldMapping
+	return unmarshal((*plain)(f))
+}
+
+// lineProtocolFields are the measurement fields that line protocol fields can be mapped to, in the units of MeasurementJson
+var lineProtocolFields = map[string]func(m *MeasurementJson, value float64){
+	"temperature":               func(m *MeasurementJson, value float64) { m.Temperature = &value },
+	"humidity":                  func(m *MeasurementJson, value float64) { m.Humidity = &value },
+	"pressure":                  func(m *MeasurementJson, value float64) { m.Pressure = roundToInt32(value, 1) },
+	"battery":                   func(m *MeasurementJson, value float64) { m.Battery = roundToInt32(value, 1) },
+	"accelerationX":             func(m *MeasurementJson, value float64) { m.AccelerationX = roundToInt32(value, 1) },
+	"accelerationY":             func(m *MeasurementJson, value float64) { m.AccelerationY = roundToInt32(value, 1) },
+	"accelerationZ":             func(m *MeasurementJson, value float64) { m.AccelerationZ = roundToInt32(value, 1) },
+	"txPower":                   func(m *MeasurementJson, value float64) { m.TxPower = roundToInt32(value, 1) },
+	"rssi":                      func(m *MeasurementJson, value float64) { m.Rssi = roundToInt32(value, 1) },
+	"movementCounter":           func(m *MeasurementJson, value float64) { m.MovementCounter = roundToInt64(value) },
+	"measurementSequenceNumber": func(m *MeasurementJson, value float64) { m.MeasurementSequenceNumber = roundToInt64(value) },
+}
+
+func roundToInt64(value float64) *int64 {
+	rounded := int64(math.Round(value))
+	return &rounded
+}
+
+// defaultLineProtocolConfig takes the field names of the measurement API and the columns of measurement,
+// which are also what the InfluxDB storage backend writes
+func defaultLineProtocolConfig() LineProtocolConfig {
+	fields := map[string]FieldMapping{
+		"temp":                        {Field: "temperature"},
+		"acceleration_x":              {Field: "accelerationX"},
+		"acceleration_y":              {Field: "accelerationY"},
+		"acceleration_z":              {Field: "accelerationZ"},
+		"battery_voltage":             {Field: "battery"},
+		"tx_power":                    {Field: "txPower"},
+		"movement_counter":            {Field: "movementCounter"},
+		"measurement_sequence_number": {Field: "measurementSequenceNumber"},
+	}
+	for field := range lineProtocolFields {
+		fields[field] = FieldMapping{Field: field}
+	}
+	return LineProtocolConfig{
+		MacTags:   []string{"mac"},
+		LabelTags: []string{"label"},
+		Fields:    fields,
+	}
+}
+
+func checkLineProtocolConfig(c LineProtocolConfig) error {
+	for name, mapping := range c.Fields {
+		if _, ok := lineProtocolFields[mapping.Field]; !ok {
+			return fmt.Errorf("line protocol field %s: unknown measurement field %s", name, mapping.Field)
+		}
+	}
+	for key := range c.Devices {
+		if tag, value, found := strings.Cut(key, "="); !found || tag == "" || value == "" {
+			return fmt.Errorf("line protocol device %s must be given as <tag>=<value>", key)
+		}
+	}
+	return nil
+}
+
+// linePoint is a parsed line of line protocol. Numeric fields are kept as float64.
+type linePoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]any
+	timestamp   *time.Time
+}
+
+// lineProtocolPrecisions are the precisions of InfluxDB 1 and 2
+var lineProtocolPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// parseLineProtocol parses all lines of the body and fails on the first invalid one
+func parseLineProtocol(body string, precision time.Duration) ([]linePoint, error) {
+	points := []linePoint{}
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := parseLine(line, precision)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// splitUnescaped splits at the separators that are not escaped with a backslash and, with quoted, not
+// inside double quotes. At most n parts are returned when n > 0.
+func splitUnescaped(s string, separator byte, quoted bool, n int) []string {
+	parts := []string{}
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == separator && !inQuotes && (n <= 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var lineUnescape = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+
+func parseLine(line string, precision time.Duration) (linePoint, error) {
+	sections := splitUnescaped(line, ' ', true, 3)
+	if len(sections) < 2 {
+		return linePoint{}, errors.New("no fields")
+	}
+
+	series := splitUnescaped(sections[0], ',', false, 0)
+	point := linePoint{
+		measurement: lineUnescape.Replace(series[0]),
+		tags:        map[string]string{},
+		fields:      map[string]any{},
+	}
+	if point.measurement == "" {
+		return linePoint{}, errors.New("no measurement")
+	}
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=', false, 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return linePoint{}, fmt.Errorf("invalid tag %s", tag)
+		}
+		point.tags[lineUnescape.Replace(kv[0])] = lineUnescape.Replace(kv[1])
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',', true, 0) {
+		kv := splitUnescaped(field, '=', true, 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return linePoint{}, fmt.Errorf("invalid field %s", field)
+		}
+		value, err := parseFieldValue(kv[1])
+		if err != nil {
+			return linePoint{}, fmt.Errorf("field %s: %w", kv[0], err)
+		}
+		point.fields[lineUnescape.Replace(kv[0])] = value
+	}
+
+	if len(sections) == 3 {
+		timestamp, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return linePoint{}, fmt.Errorf("invalid timestamp %s", sections[2])
+		}
+		if timestamp > math.MaxInt64/int64(precision) || timestamp < math.MinInt64/int64(precision) {
+			return linePoint{}, fmt.Errorf("timestamp %s is out of range", sections[2])
+		}
+		t := time.Unix(0, timestamp*int64(precision))
+		point.timestamp = &t
+	}
+	return point, nil
+}
+
+// parseFieldValue returns floats, integers and unsigned integers as float64, booleans as bool and strings as string
+func parseFieldValue(value string) (any, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		if len(value) < 2 || !strings.HasSuffix(value, `"`) {
+			return nil, fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1]), nil
+	case strings.HasSuffix(value, "i"):
+		i, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+		return float64(i), err
+	case strings.HasSuffix(value, "u"):
+		u, err := strconv.ParseUint(strings.TrimSuffix(value, "u"), 10, 64)
+		return float64(u), err
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s", value)
+	}
+	return f, nil
+}
+
+// pointMac returns the MAC of the device that the point belongs to, an empty string when the point does
+// not name a device. A point whose tags map to different devices is rejected.
+func pointMac(point linePoint) (string, error) {
+	c := config.LineProtocol
+	tags := make([]string, 0, len(point.tags))
+	for tag := range point.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	matched, matchedKey := "", ""
+	for _, tag := range tags {
+		key := tag + "=" + point.tags[tag]
+		device, ok := c.Devices[key]
+		if !ok {
+			continue
+		}
+		mac, err := deviceMac(device)
+		if err != nil {
+			return "", err
+		}
+		if matchedKey != "" && deviceKey(mac) != deviceKey(matched) {
+			return "", fmt.Errorf("devices %s and %s both match, the point is ambiguous", matchedKey, key)
+		}
+		matched, matchedKey = mac, key
+	}
+	if matchedKey != "" {
+		return matched, nil
+	}
+	for _, tag := range c.MacTags {
+		if mac, ok := point.tags[tag]; ok {
+			return mac, nil
+		}
+	}
+	for _, tag := range c.LabelTags {
+		if label, ok := point.tags[tag]; ok {
+			return deviceMac(label)
+		}
+	}
+	return "", nil
+}
+
+// deviceMac returns the MAC as is, or the MAC of the active device with the label
+func deviceMac(device string) (string, error) {
+	if _, err := normalizeMac(device); err == nil {
+		return device, nil
+	}
+	found, err := lookupDeviceByLabel(device)
+	if err != nil {
+		return "", err
+	}
+	return found.Mac, nil
+}
+
+// pointsToMeasurements maps the points onto measurements, merging the fields of points with the same
+// device and time. Points without a time take the time of receiving. Points of unknown labels are skipped
+// and counted.
+func pointsToMeasurements(points []linePoint, received time.Time) ([]*MeasurementJson, error) {
+	c := config.LineProtocol
+	type key struct {
+		mac  string
+		time int64
+	}
+	byKey := map[key]*MeasurementJson{}
+	keys := []key{}
+
+	for _, point := range points {
+		if len(c.Measurements) > 0 && !slices.Contains(c.Measurements, point.measurement) {
+			continue
+		}
+		mac, err := pointMac(point)
+		if errors.Is(err, errUnknownDevice) {
+			countRejected(RejectReasonUnknownLabel)
+			log.Warn().Err(err).Msgf("Skipping point of %s", point.measurement)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", point.measurement, err)
+		}
+		if mac == "" {
+			continue
+		}
+		timestamp := received
+		if point.timestamp != nil {
+			timestamp = *point.timestamp
+		}
+
+		k := key{mac: strings.ToLower(mac), time: timestamp.UnixNano()}
+		m, existing := byKey[k]
+		if !existing {
+			m = &MeasurementJson{MAC: mac, Timestamp: &timestamp}
+		}
+		mapped := false
+		for field, value := range point.fields {
+			mapping, ok := c.Fields[point.measurement+"."+field]
+			if !ok {
+				mapping, ok = c.Fields[field]
+			}
+			number, isNumber := value.(float64)
+			if !ok || !isNumber {
+				continue
+			}
+			if mapping.Scale != 0 {
+				number *= mapping.Scale
+			}
+			lineProtocolFields[mapping.Field](m, number)
+			mapped = true
+		}
+		if mapped && !existing {
+			byKey[k] = m
+			keys = append(keys, k)
+		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].time < keys[j].time })
+	measurements := make([]*MeasurementJson, 0, len(keys))
+	for _, k := range keys {
+		measurements = append(measurements, byKey[k])
+	}
+	return measurements, nil
+}
+
+// lineProtocolError responds in the error format of the InfluxDB version of the endpoint
+func lineProtocolError(c echo.Context, v2 bool, status int, message string) error {
+	if v2 {
+		code := "invalid"
+		if status >= 500 {
+			code = "internal error"
+		}
+		return c.JSON(status, map[string]string{"code": code, "message": message})
+	}
+	return c.JSON(status, map[string]string{"error": message})
+}
+
+// postLineProtocol returns the handler of /write, or of /api/v2/write with v2
+func postLineProtocol(v2 bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		precision, ok := lineProtocolPrecisions[c.QueryParam("precision")]
+		if !ok {
+			return lineProtocolError(c, v2, 400, fmt.Sprintf("invalid precision %s", c.QueryParam("precision")))
+		}
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return lineProtocolError(c, v2, 400, "failed to read body")
+		}
+
+		points, err := parseLineProtocol(string(body), precision)
+		if err != nil {
+			countRejected(RejectReasonInvalidPayload)
+			log.Error().Err(err).Msg("Failed to parse line protocol")
+			return lineProtocolError(c, v2, 400, err.Error())
+		}
+		batch, err := pointsToMeasurements(points, time.Now())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to map line protocol")
+			return lineProtocolError(c, v2, 500, "failed to read devices")
+		}
+		if len(batch) > maxBatchSize {
+			return lineProtocolError(c, v2, 413, fmt.Sprintf("batch size is limited to %d measurements", maxBatchSize))
+		}
+		for _, m := range batch {
+			if m.Gateway == nil {
+				m.Gateway = requestIdentity(c)
+			}
+		}
+		log.Info().Msgf("Received %d measurements from %d points of line protocol", len(batch), len(points))
+
+		results, err := storeMeasurementBatch(batch)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to write line protocol data")
+			return lineProtocolError(c, v2, 500, "failed to write data")
+		}
+		failed := []string{}
+		for _, result := range results {
+			if result.Status == MeasurementStatusFailed || result.Status == MeasurementStatusRejected {
+				failed = append(failed, fmt.Sprintf("%s: %s", result.MAC, result.Error))
+			}
+		}
+		if len(failed) > 0 {
+			return lineProtocolError(c, v2, 400, fmt.Sprintf("partial write: %s", strings.Join(failed, ", ")))
+		}
+		return c.NoContent(204)
+	}
+}
+
+// getPing answers the health check of InfluxDB clients
+func getPing(c echo.Context) error {
+	c.Response().Header().Set("X-Influxdb-Version", "ruuvitag-httpserver")
+	return c.NoContent(204)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	at := func(sec, nsec int64) *time.Time {
+		t := time.Unix(sec, nsec)
+		return &t
+	}
+	tests := []struct {
+		name      string
+		body      string
+		precision time.Duration
+		want      []linePoint
+	}{
+		{
+			name:      "tags, fields and timestamp",
+			body:      "ruuvi,mac=cb:b8:33:4c:88:4f,label=sauna temperature=24.3,pressure=100044i,humidity=53.49 1700000000000000000",
+			precision: time.Nanosecond,
+			want: []linePoint{{
+				measurement: "ruuvi",
+				tags:        map[string]string{"mac": "cb:b8:33:4c:88:4f", "label": "sauna"},
+				fields:      map[string]any{"temperature": 24.3, "pressure": float64(100044), "humidity": 53.49},
+				timestamp:   at(1700000000, 0),
+			}},
+		},
+		{
+			name:      "without timestamp",
+			body:      "ruuvi temperature=21",
+			precision: time.Nanosecond,
+			want: []linePoint{{
+				measurement: "ruuvi",
+				tags:        map[string]string{},
+				fields:      map[string]any{"temperature": float64(21)},
+			}},
+		},
+		{
+			name:      "field types",
+			body:      `ruuvi battery=2977u,moving=t,still=FALSE,gateway="my \"gw\"",rssi=-60i`,
+			precision: time.Nanosecond,
+			want: []linePoint{{
+				measurement: "ruuvi",
+				tags:        map[string]string{},
+				fields: map[string]any{
+					"battery": float64(2977), "moving": true, "still": false, "gateway": `my "gw"`, "rssi": float64(-60),
+				},
+			}},
+		},
+		{
+			name:      "escapes",
+			body:      `my\ ruuvi,room\=name=living\ room,loc=a\,b air\ temp=20,note="a, b=c d"`,
+			precision: time.Nanosecond,
+			want: []linePoint{{
+				measurement: "my ruuvi",
+				tags:        map[string]string{"room=name": "living room", "loc": "a,b"},
+				fields:      map[string]any{"air temp": float64(20), "note": "a, b=c d"},
+			}},
+		},
+		{
+			name:      "precision",
+			body:      "ruuvi temperature=20 1700000000123",
+			precision: time.Millisecond,
+			want: []linePoint{{
+				measurement: "ruuvi",
+				tags:        map[string]string{},
+				fields:      map[string]any{"temperature": float64(20)},
+				timestamp:   at(1700000000, 123000000),
+			}},
+		},
+		{
+			name:      "blank lines and comments",
+			body:      "\n# comment\nruuvi temperature=20 1700000000\n\n  ruuvi humidity=40 1700000001  \n",
+			precision: time.Second,
+			want: []linePoint{
+				{
+					measurement: "ruuvi",
+					tags:        map[string]string{},
+					fields:      map[string]any{"temperature": float64(20)},
+					timestamp:   at(1700000000, 0),
+				},
+				{
+					measurement: "ruuvi",
+					tags:        map[string]string{},
+					fields:      map[string]any{"humidity": float64(40)},
+					timestamp:   at(1700000001, 0),
+				},
+			},
+		},
+		{
+			name:      "empty body",
+			body:      "",
+			precision: time.Nanosecond,
+			want:      []linePoint{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := parseLineProtocol(tt.body, tt.precision)
+			if err != nil {
+				t.Fatalf("parseLineProtocol() error = %v", err)
+			}
+			if !reflect.DeepEqual(points, tt.want) {
+				t.Errorf("parseLineProtocol() = %+v, want %+v", points, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLineProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		precision time.Duration
+		wantErr   string
+	}{
+		{name: "no fields", body: "ruuvi", precision: time.Nanosecond, wantErr: "line 1: no fields"},
+		{name: "no measurement", body: ",mac=a temperature=20", precision: time.Nanosecond, wantErr: "line 1: no measurement"},
+		{name: "invalid tag", body: "ruuvi,mac temperature=20", precision: time.Nanosecond, wantErr: "line 1: invalid tag mac"},
+		{name: "invalid field", body: "ruuvi temperature", precision: time.Nanosecond, wantErr: "line 1: invalid field temperature"},
+		{name: "invalid value", body: "ruuvi temperature=warm", precision: time.Nanosecond, wantErr: "line 1: field temperature: invalid value warm"},
+		{name: "unterminated string", body: `ruuvi gateway="gw`, precision: time.Nanosecond, wantErr: `line 1: field gateway: unterminated string "gw`},
+		{name: "invalid timestamp", body: "ruuvi temperature=20 yesterday", precision: time.Nanosecond, wantErr: "line 1: invalid timestamp yesterday"},
+		{name: "timestamp out of range", body: "ruuvi temperature=20 9223372036854775807", precision: time.Second, wantErr: "line 1: timestamp 9223372036854775807 is out of range"},
+		{name: "negative timestamp out of range", body: "ruuvi temperature=20 -9223372036854775807", precision: time.Hour, wantErr: "line 1: timestamp -9223372036854775807 is out of range"},
+		{name: "line number", body: "ruuvi temperature=20\n\nruuvi", precision: time.Nanosecond, wantErr: "line 3: no fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLineProtocol(tt.body, tt.precision)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseLineProtocol() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPointMac(t *testing.T) {
+	previousConfig, previousDevices, previousLoaded := config, devices, devicesLoaded
+	t.Cleanup(func() { config, devices, devicesLoaded = previousConfig, previousDevices, previousLoaded })
+	config = defaultConfig()
+	config.LineProtocol = LineProtocolConfig{
+		MacTags:   []string{"mac"},
+		LabelTags: []string{"label"},
+		Devices: map[string]string{
+			"room=sauna":    "aa:bb:cc:dd:ee:01",
+			"host=stove":    "AA-BB-CC-DD-EE-01",
+			"room=garage":   "aa:bb:cc:dd:ee:02",
+			"host=workshop": "garage",
+			"host=shed":     "aa:bb:cc:dd:ee:03",
+		},
+	}
+	devices = map[string]model.Device{
+		"aa:bb:cc:dd:ee:02": {ID: 2, Mac: "aa:bb:cc:dd:ee:02", Label: "garage", Status: DeviceStatusActive},
+	}
+	devicesLoaded = true
+
+	tests := []struct {
+		name    string
+		tags    map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "device by tag", tags: map[string]string{"room": "sauna"}, want: "aa:bb:cc:dd:ee:01"},
+		{name: "device before the mac tag", tags: map[string]string{"room": "sauna", "mac": "aa:bb:cc:dd:ee:09"}, want: "aa:bb:cc:dd:ee:01"},
+		{name: "mac tag", tags: map[string]string{"room": "kitchen", "mac": "aa:bb:cc:dd:ee:09"}, want: "aa:bb:cc:dd:ee:09"},
+		{name: "no device", tags: map[string]string{"room": "kitchen"}},
+		{name: "tags of the same device", tags: map[string]string{"room": "sauna", "host": "stove"}, want: "aa:bb:cc:dd:ee:01"},
+		{name: "tags of the same device by label", tags: map[string]string{"room": "garage", "host": "workshop"}, want: "aa:bb:cc:dd:ee:02"},
+		{name: "tags of different devices", tags: map[string]string{"room": "sauna", "host": "shed"},
+			wantErr: "devices host=shed and room=sauna both match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The device must not depend on the order of the tag map
+			for range 20 {
+				got, err := pointMac(linePoint{measurement: "ruuvi", tags: tt.tags})
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Fatalf("pointMac() error = %v, want %s", err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil || got != tt.want {
+					t.Fatalf("pointMac() = %q, %v, want %q", got, err, tt.want)
+				}
+			}
+		})
+	}
+}
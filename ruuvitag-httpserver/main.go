@@ -1,11 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,37 +17,72 @@ import (
 	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
 
 	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
-
-	_ "github.com/lib/pq"
 )
 
+// MeasurementJson holds a single reading. Fields that are not available are nil and stored as NULL.
 type MeasurementJson struct {
-	MAC                       string  `json:"mac"`
-	Temperature               float64 `json:"temp"`
-	Humidity                  float64 `json:"humidity"`
-	Pressure                  int32   `json:"pressure"`
-	AccelerationX             int32   `json:"accelerationX"`
-	AccelerationY             int32   `json:"accelerationY"`
-	AccelerationZ             int32   `json:"accelerationZ"`
-	Battery                   int32   `json:"battery"`
-	TxPower                   int32   `json:"txPower"`
-	MovementCounter           int64   `json:"movementCounter"`
-	MeasurementSequenceNumber int64   `json:"measurementSequenceNumber"`
-	Rssi                      int32   `json:"rssi"`
+	MAC                       string   `json:"mac"`
+	Temperature               *float64 `json:"temp"`
+	Humidity                  *float64 `json:"humidity"`
+	Pressure                  *int32   `json:"pressure"`
+	AccelerationX             *int32   `json:"accelerationX"`
+	AccelerationY             *int32   `json:"accelerationY"`
+	AccelerationZ             *int32   `json:"accelerationZ"`
+	Battery                   *int32   `json:"battery"`
+	TxPower                   *int32   `json:"txPower"`
+	MovementCounter           *int64   `json:"movementCounter"`
+	MeasurementSequenceNumber *int64   `json:"measurementSequenceNumber"`
+	Rssi                      *int32   `json:"rssi"`
+	// Gateway is the MAC or name of the gateway that relayed the reading, if any
+	Gateway *string `json:"gateway,omitempty"`
+	// Timestamp is optional, the time of receiving is used when it is missing
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+func (m *MeasurementJson) String() string {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf("measurement for %s", m.MAC)
+	}
+	return string(data)
+}
+
+const (
+	MeasurementStatusOk      = "ok"
+	MeasurementStatusPending = "pending"
+	MeasurementStatusFailed  = "failed"
+	// MeasurementStatusRejected is an implausible measurement, see Violations
+	MeasurementStatusRejected = "rejected"
+	// MeasurementStatusSpooled is kept on disk until Postgres and MQTT are available
+	MeasurementStatusSpooled = "spooled"
+
+	maxBatchSize = 1000
+)
+
+// MeasurementResult tells the outcome of a single measurement in a batch
+type MeasurementResult struct {
+	Index  int    `json:"index"`
+	MAC    string `json:"mac"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Violations lists the validation rules that a rejected measurement breaks
+	Violations []Violation `json:"violations,omitempty"`
 }
 
 var (
 	db         *sql.DB
 	mqttClient mqtt.Client
 	envFile    = map[string]string{}
-	devices    = map[string]int32{}
 )
 
 func loadConfiguration() {
@@ -53,10 +92,15 @@ func loadConfiguration() {
 		log.Error().Err(err).Msg("Failed to read from env file")
 		panic(err)
 	}
+	if err := loadConfigFile(); err != nil {
+		log.Error().Err(err).Msgf("Failed to read %s", configPath)
+		panic(err)
+	}
 }
 
 func main() {
 	loadConfiguration()
+	configureAvailability()
 
 	var err error
 	connectString := envFile["POSTGRESQL_CONN_URL"]
@@ -69,199 +113,472 @@ func main() {
 	db.SetConnMaxLifetime(30 * time.Minute)
 	defer db.Close()
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	migrateOnStartup()
+	if err := openStorage(); err != nil {
+		log.Error().Err(err).Msg("Failed to open storage")
+		panic(err)
+	}
+	spool, err = openSpool(config.Spool)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open spool")
+		panic(err)
+	}
+	configureAuth()
+
 	opts := mqtt.NewClientOptions().
 		AddBroker(envFile["MQTT_BROKER"]).
 		SetClientID("ruuvitag-httpserver").
 		SetUsername(envFile["MQTT_USER_NAME"]).
 		SetPassword(envFile["MQTT_USER_PASSWORD"]).
-		SetKeepAlive(2 * time.Second).
-		SetPingTimeout(1 * time.Second)
+		SetKeepAlive(2*time.Second).
+		SetPingTimeout(1*time.Second).
+		SetWill(serverAvailabilityTopic, payloadOffline, 1, true).
+		SetOnConnectHandler(onMqttConnect)
 
 	mqttClient = mqtt.NewClient(opts)
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		log.Fatal().Msgf("MQTT connection error: %v", token.Error())
 	}
 
-	postMeasurement := func(c echo.Context) error {
-		m := new(MeasurementJson)
-		if err := c.Bind(m); err != nil {
-			log.Error().Err(err).Msgf("Failed to bind payload into measurement")
+	if err := loadLastReadings(); err != nil {
+		log.Error().Err(err).Msg("Failed to load the last readings, silent devices get a grace period")
+	}
+	// Devices are loaded lazily again on the next measurement if this fails
+	if err := loadDevices(); err != nil {
+		log.Error().Err(err).Msg("Failed to load devices on startup")
+	}
+	go syncDevices()
+	go drainSpool()
+	startNotifiers()
+	go runAlerts()
+	go runGaps()
+	go watchAvailability()
+	go ingestMqttMeasurements()
+	go runRollups()
+	go runBatteryTrends()
+
+	postMeasurementBatch := func(c echo.Context) error {
+		var batch []*MeasurementJson
+		if err := c.Bind(&batch); err != nil {
+			log.Error().Err(err).Msgf("Failed to bind payload into measurement batch")
+			countRejected(RejectReasonInvalidPayload)
 			return echo.NewHTTPError(400, "Invalid data")
 		}
-		log.Info().Msgf("Received new measurement: %v", m)
+		if len(batch) > maxBatchSize {
+			return echo.NewHTTPError(400, fmt.Sprintf("Invalid data: batch size is limited to %d", maxBatchSize))
+		}
+		for _, m := range batch {
+			if m != nil && m.Gateway == nil {
+				m.Gateway = requestIdentity(c)
+			}
+		}
+		log.Info().Msgf("Received batch of %d measurements", len(batch))
 
-		err := storeMeasurement(m)
+		results, err := storeMeasurementBatch(batch)
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed to write to data")
+			log.Error().Err(err).Msgf("Failed to write batch")
 			return echo.NewHTTPError(500, "Failed to write data")
 		}
 
-		return c.NoContent(200)
+		return c.JSON(200, results)
 	}
 
 	postBinaryMeasurement := func(c echo.Context) error {
 		binaryData, err := io.ReadAll(c.Request().Body)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to read binary body")
+			countRejected(RejectReasonInvalidPayload)
 			return echo.NewHTTPError(400, "Invalid data")
 		}
 
-		if len(binaryData) < 16 {
-			log.Error().Err(err).Msgf("Binary body is wrong length: %d", len(binaryData))
-			return echo.NewHTTPError(400, "Invalid data: wrong length")
-		}
-		// Check that data has expected manufacturer id and version
-		// Mnufacturer: 0x1CA3
-		// Version: 0x01
-		if !bytes.HasPrefix(binaryData, []byte{0x1C, 0xA3, 0x01}) {
-			log.Error().Msgf("Data prefix is unexpected. Full data: %v", binaryData)
-			return echo.NewHTTPError(400, "Invalid data: prefix is unexpected")
+		m, err := decodeManufacturerData(binaryData)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to decode binary body: %x", binaryData)
+			countRejected(RejectReasonInvalidData)
+			return echo.NewHTTPError(400, fmt.Sprintf("Invalid data: %v", err))
 		}
 
-		rawTemperature := int16(binaryData[3])<<8 | int16(binaryData[4])
-		temperature := 0.005 * float64(rawTemperature)
-
-		rawHumidity := uint16(binaryData[5])<<8 | uint16(binaryData[6])
-		humidity := 0.0025 * float64(rawHumidity)
-
-		rawBattery := uint16(binaryData[7])<<3 | uint16(binaryData[8])>>5
-		battery := rawBattery + 1600
-
-		rawMac := binaryData[9:15]
-		var hexParts []string
-		for _, b := range rawMac {
-			hexParts = append(hexParts, fmt.Sprintf("%02x", b))
+		// Data format 3 does not carry the MAC address, and format 5 may have it marked as not available
+		if m.MAC == "" {
+			m.MAC = c.QueryParam("mac")
 		}
-		macString := strings.Join(hexParts, ":")
-
-		m := new(MeasurementJson)
-		m.Temperature = temperature
-		m.Humidity = humidity
-		m.Battery = int32(battery)
-		m.MAC = macString
+		if m.MAC == "" {
+			log.Error().Msgf("No MAC address in data or query. Full data: %x", binaryData)
+			countRejected(RejectReasonMissingMac)
+			return echo.NewHTTPError(400, "Invalid data: MAC address missing")
+		}
+		if rssiParam := c.QueryParam("rssi"); rssiParam != "" {
+			rssi, err := strconv.ParseInt(rssiParam, 10, 32)
+			if err != nil {
+				countRejected(RejectReasonInvalidData)
+				return echo.NewHTTPError(400, "Invalid rssi")
+			}
+			rssi32 := int32(rssi)
+			m.Rssi = &rssi32
+		}
+		m.Gateway = requestIdentity(c)
 
 		log.Info().Msgf("Received new measurement: %v", m)
 
-		err = storeMeasurement(m)
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed to write data")
-			return echo.NewHTTPError(500, "Failed to write data")
+		if err := storeMeasurement(m); err != nil {
+			return measurementErrorResponse(c, err)
 		}
-
 		return c.NoContent(200)
 	}
 
+	ingest := requireScope(TokenScopeIngest)
+	admin := requireScope(TokenScopeAdmin)
+
 	e := echo.New()
 	e.Static("/static", "assets")
 	e.Static("/css", "css")
-	e.Use(middleware.Logger())
-	e.POST("/measurements", postMeasurement)
-	e.POST("/v2/measurements", postBinaryMeasurement)
+	// The token of /write may be in the query, its requests are logged by path only
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Skipper: func(c echo.Context) bool { return c.Path() == queryTokenPath },
+	}))
+	pathLogger := middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Format: strings.Replace(middleware.DefaultLoggerConfig.Format, `"uri":"${uri}"`, `"path":"${path}"`, 1),
+	})
+	e.GET("/measurements", getMeasurements)
+	e.POST("/measurements", postMeasurement, ingest)
+	e.POST("/measurements/batch", postMeasurementBatch, ingest)
+	e.POST("/v2/measurements", postBinaryMeasurement, ingest)
+	e.POST("/gateway", postGatewayMeasurements, ingest)
+	e.POST("/station", postStationMeasurements, ingest)
+	// InfluxDB clients such as Telegraf gzip their writes
+	e.POST(queryTokenPath, postLineProtocol(false), pathLogger, ingest, middleware.Decompress())
+	e.POST("/api/v2/write", postLineProtocol(true), ingest, middleware.Decompress())
+	e.GET("/ping", getPing)
+	e.HEAD("/ping", getPing)
+	e.GET("/devices", getDevices)
+	e.GET("/devices/:mac", getDevice)
+	e.GET("/devices/:mac/battery", getDeviceBattery)
+	e.POST("/devices", postDevice, admin)
+	e.PATCH("/devices/:mac", patchDevice, admin)
+	e.DELETE("/devices/:mac", deleteDevice, admin)
+	e.POST("/devices/:mac/approve", postApproveDevice, admin)
+	e.GET("/stream", getStream)
+	e.GET("/ws", getWebSocket)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/status", getStatus)
+	e.GET("/alerts", getAlerts)
+	e.GET("/battery", getBatteries)
+	e.GET("/gaps", getGaps)
+	e.GET("/uptime", getUptime)
 	e.Logger.Fatal(e.Start(":1323"))
 }
 
+func postMeasurement(c echo.Context) error {
+	m := new(MeasurementJson)
+	if err := c.Bind(m); err != nil {
+		log.Error().Err(err).Msgf("Failed to bind payload into measurement")
+		countRejected(RejectReasonInvalidPayload)
+		return echo.NewHTTPError(400, "Invalid data")
+	}
+	if m.Gateway == nil {
+		m.Gateway = requestIdentity(c)
+	}
+	log.Info().Msgf("Received new measurement: %v", m)
+
+	if err := storeMeasurement(m); err != nil {
+		return measurementErrorResponse(c, err)
+	}
+	return c.NoContent(200)
+}
+
+// storeMeasurement validates the measurement and writes it, or spools it when it cannot be written now
 func storeMeasurement(m *MeasurementJson) error {
-	var err error
+	var validationErr *ValidationError
+	if err := validateMeasurement(m); errors.As(err, &validationErr) {
+		rejectMeasurement(m, validationErr)
+		return err
+	}
 
-	if len(devices) == 0 {
-		stmt := SELECT(Device.ID, Device.Label, Device.Mac).FROM(Device)
-		var allDevices []struct {
-			model.Device
-		}
-		err = stmt.Query(db, &allDevices)
+	if spool.depth() > 0 || !mqttClient.IsConnectionOpen() {
+		return spoolMeasurement(m, nil)
+	}
+	err := writeAccepted(m)
+	if isTransientError(err) {
+		return spoolMeasurement(m, err)
+	}
+	return err
+}
+
+// measurementErrorResponse is the response to a measurement that storeMeasurement failed to store. Errors
+// of the measurement are the client's, only the others are server errors.
+func measurementErrorResponse(c echo.Context, err error) error {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return c.JSON(422, validationErr)
+	case errors.Is(err, errInvalidMac):
+		return echo.NewHTTPError(400, fmt.Sprintf("Invalid data: %v", err))
+	case errors.Is(err, errInactiveDevice):
+		return echo.NewHTTPError(409, err.Error())
+	}
+	log.Error().Err(err).Msgf("Failed to write data")
+	return echo.NewHTTPError(500, "Failed to write data")
+}
+
+// isTransientError is whether the write failed because the connection to Postgres failed, and not because
+// of the measurement. Only these writes are spooled, everything else is an error for the client.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// Connection exceptions and the server shutting down or not accepting connections yet
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P")
+	}
+	return false
+}
+
+// writeAccepted writes a validated measurement, or quarantines it when the device is unknown
+func writeAccepted(m *MeasurementJson) error {
+	device, err := lookupDevice(m.MAC)
+	if errors.Is(err, errUnknownDevice) {
+		unknownMacCounter.Inc()
+		err = quarantineMeasurement(db, m)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to select all devices")
-			return err
+			countQuarantineError(err)
+			log.Error().Err(err).Msgf("Failed to quarantine data for %s", m.MAC)
 		}
-		for _, device := range allDevices {
-			devices[strings.ToLower(device.Mac)] = int32(device.ID)
-
-			mqttSensorMac := strings.ReplaceAll(strings.ToLower(device.Mac), ":", "_")
-			discoveryTopic := fmt.Sprintf("homeassistant/sensor/%s_temperature/config", mqttSensorMac)
-			stateTopic := fmt.Sprintf("home/temperature/%s", mqttSensorMac)
-
-			payload := map[string]any{
-				"name":                device.Label,
-				"unique_id":           fmt.Sprintf("%s_temperature", mqttSensorMac),
-				"state_topic":         stateTopic,
-				"unit_of_measurement": "°C",
-				"device_class":        "temperature",
-				"value_template":      "{{ value_json.temp }}",
-			}
+		return err
+	}
+	if err != nil {
+		return err
+	}
 
-			data, _ := json.Marshal(payload)
-			token := mqttClient.Publish(discoveryTopic, 0, true, data)
-			token.WaitTimeout(500 * time.Millisecond)
-			log.Printf("Published discovery for %s", mqttSensorMac)
+	written, err := writePrimary(db, device, m)
+	if err != nil {
+		dbErrorCounter.Inc()
+		log.Error().Err(err).Msgf("Failed to write data for device %d", device.ID)
+		return err
+	}
+	acceptedCounter.Inc()
+	fanOut(device, m)
+	if written {
+		onMeasurementStored(device, m)
+	}
+	return nil
+}
 
+// storeMeasurementBatch writes all measurements in a single transaction. A failing item does not
+// fail the others; each item gets its own result so that clients can retry just the failed ones.
+// When the transaction fails because Postgres is unavailable the valid measurements are spooled, and an
+// error is returned when spooling fails too or the transaction failed for another reason.
+func storeMeasurementBatch(batch []*MeasurementJson) ([]MeasurementResult, error) {
+	results := make([]MeasurementResult, len(batch))
+	accepted := []int{}
+	for i, m := range batch {
+		if m == nil {
+			results[i] = MeasurementResult{Index: i, Status: MeasurementStatusFailed, Error: "empty measurement"}
+			continue
+		}
+		results[i] = MeasurementResult{Index: i, MAC: m.MAC, Status: MeasurementStatusOk}
+
+		var validationErr *ValidationError
+		if err := validateMeasurement(m); errors.As(err, &validationErr) {
+			rejectMeasurement(m, validationErr)
+			results[i].Status = MeasurementStatusRejected
+			results[i].Error = validationErr.Message
+			results[i].Violations = validationErr.Violations
+			continue
 		}
+		accepted = append(accepted, i)
+	}
+	if len(accepted) == 0 {
+		return results, nil
 	}
 
-	deviceId, has := devices[strings.ToLower(m.MAC)]
-	if !has {
-		log.Warn().Msgf("Unknown mac %s, skipping writing data to Postgresql", m.MAC)
-		return fmt.Errorf("unknown mac %s, skipping writing data to Postgresql", m.MAC)
+	var err error
+	if spool.depth() == 0 && mqttClient.IsConnectionOpen() {
+		err = writeAcceptedBatch(batch, accepted, results)
+		if err == nil {
+			return results, nil
+		}
+		log.Error().Err(err).Msg("Failed to write measurement batch")
+		if !isTransientError(err) {
+			return nil, err
+		}
 	}
-	createdAt := time.Now().Truncate(time.Minute)
-	var measurement model.Measurement
+	for _, i := range accepted {
+		if err := spoolMeasurement(batch[i], err); err != nil {
+			return nil, err
+		}
+		results[i].Status = MeasurementStatusSpooled
+	}
+	return results, nil
+}
 
-	selectMeasurementStmt := SELECT(Measurement.AllColumns).FROM(Measurement).WHERE(Measurement.DeviceID.EQ(Int32(deviceId)).AND(Measurement.CreatedAt.EQ(TimestampzT(createdAt))))
+// writeAcceptedBatch writes the accepted measurements of the batch, setting their results. The results
+// are not used when an error is returned.
+func writeAcceptedBatch(batch []*MeasurementJson, accepted []int, results []MeasurementResult) error {
+	written := make([]bool, len(batch))
+	batchDevices := make([]model.Device, len(batch))
 
-	err = selectMeasurementStmt.Query(db, &measurement)
+	tx, err := db.Begin()
 	if err != nil {
-		measurement.ID = -1
-		measurement.CreatedAt = createdAt
-	}
-
-	measurement.DeviceID = int32(deviceId)
-	measurement.Temperature = &m.Temperature
-	measurement.Humidity = &m.Humidity
-	measurement.Pressure = &m.Pressure
-	measurement.AccelerationX = &m.AccelerationX
-	measurement.AccelerationY = &m.AccelerationY
-	measurement.AccelerationZ = &m.AccelerationZ
-	measurement.BatteryVoltage = &m.Battery
-	measurement.TxPower = &m.TxPower
-	measurement.MovementCounter = &m.MovementCounter
-	measurement.MeasurementSequenceNumber = &m.MeasurementSequenceNumber
-	measurement.Rssi = &m.Rssi
-
-	if measurement.ID == -1 {
-		insertStmt := Measurement.
-			INSERT(Measurement.MutableColumns).
-			MODEL(measurement)
-
-		_, err = insertStmt.Exec(db)
-
-		selectRoomStmt := SELECT(Device.AllColumns).FROM(Device).WHERE(Device.ID.EQ(Int32(deviceId)))
-		var device model.Device
-		err := selectRoomStmt.Query(db, &device)
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed to get device label for id %d", deviceId)
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, i := range accepted {
+		m := batch[i]
+		device, err := lookupDevice(m.MAC)
+		unknown := errors.Is(err, errUnknownDevice)
+		if err != nil && !unknown {
 			return err
 		}
-		room := device.Label
+		batchDevices[i] = device
 
-		mqttSensorMac := strings.ReplaceAll(strings.ToLower(device.Mac), ":", "_")
-		stateTopic := fmt.Sprintf("home/temperature/%s", mqttSensorMac)
-		payload := map[string]any{
-			"room": room,
-			"temp": measurement.Temperature,
+		// A failed statement aborts the whole transaction in Postgres, so every item gets its own savepoint
+		if _, err := tx.Exec("SAVEPOINT batch_item"); err != nil {
+			return err
 		}
-		data, _ := json.Marshal(payload)
-
-		token := mqttClient.Publish(stateTopic, 0, false, data)
-		published := token.WaitTimeout(500 * time.Millisecond)
-		if published {
-			log.Info().Msgf("Published state %.2f°C for %s", *measurement.Temperature, room)
+		if unknown {
+			unknownMacCounter.Inc()
+			results[i].Status = MeasurementStatusPending
+			err = quarantineMeasurement(tx, m)
+			if err != nil {
+				countQuarantineError(err)
+			}
 		} else {
-			log.Error().Msgf("Failed to publish state for %s", m.MAC)
+			written[i], err = writePrimary(tx, device, m)
+			if err != nil {
+				dbErrorCounter.Inc()
+			}
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to write data for device %d", device.ID)
+			results[i].Status = MeasurementStatusFailed
+			results[i].Error = "failed to write data"
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT batch_item"); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT batch_item"); err != nil {
+			return err
 		}
 	}
 
-	if err != nil {
-		log.Error().Err(err).Msgf("Failed to write data for device %d", deviceId)
+	if err := tx.Commit(); err != nil {
+		dbErrorCounter.Inc()
 		return err
 	}
+
+	for _, i := range accepted {
+		m := batch[i]
+		if results[i].Status == MeasurementStatusOk {
+			acceptedCounter.Inc()
+			fanOut(batchDevices[i], m)
+		}
+		if written[i] {
+			onMeasurementStored(batchDevices[i], m)
+		}
+	}
 	return nil
 }
+
+// writeMeasurement upserts the measurement into its time bucket, merging it with a measurement that is
+// already in the bucket as configured for the device. Returns whether a row was inserted or updated.
+func writeMeasurement(db qrm.DB, device model.Device, m *MeasurementJson) (bool, error) {
+	rule := bucketRule(device)
+	createdAt := time.Now()
+	if m.Timestamp != nil {
+		createdAt = *m.Timestamp
+	}
+
+	measurement := model.Measurement{
+		DeviceID:                  device.ID,
+		CreatedAt:                 rule.bucketTime(createdAt),
+		Temperature:               m.Temperature,
+		Humidity:                  m.Humidity,
+		Pressure:                  m.Pressure,
+		AccelerationX:             m.AccelerationX,
+		AccelerationY:             m.AccelerationY,
+		AccelerationZ:             m.AccelerationZ,
+		BatteryVoltage:            m.Battery,
+		TxPower:                   m.TxPower,
+		MovementCounter:           m.MovementCounter,
+		MeasurementSequenceNumber: m.MeasurementSequenceNumber,
+		Rssi:                      m.Rssi,
+		Gateway:                   m.Gateway,
+		SampleCount:               1,
+		TemperatureCount:          readingCount(m.Temperature),
+		HumidityCount:             readingCount(m.Humidity),
+		PressureCount:             readingCount(m.Pressure),
+		AccelerationXCount:        readingCount(m.AccelerationX),
+		AccelerationYCount:        readingCount(m.AccelerationY),
+		AccelerationZCount:        readingCount(m.AccelerationZ),
+		BatteryVoltageCount:       readingCount(m.Battery),
+		RssiCount:                 readingCount(m.Rssi),
+	}
+
+	insertStmt := Measurement.
+		INSERT(Measurement.MutableColumns).
+		MODEL(measurement).
+		ON_CONFLICT(Measurement.DeviceID, Measurement.CreatedAt)
+
+	var upsertStmt InsertStatement
+	switch rule.Merge {
+	case MergeLast:
+		upsertStmt = insertStmt.DO_UPDATE(SET(lastAssignments()...))
+	case MergeAverage:
+		upsertStmt = insertStmt.DO_UPDATE(SET(averageAssignments()...))
+	default:
+		// First keeps the stored row, and raw readings only conflict when they are the same reading
+		upsertStmt = insertStmt.DO_NOTHING()
+	}
+
+	result, err := upsertStmt.Exec(db)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	// Rollups only look back so far on their own
+	if rows > 0 && createdAt.Before(time.Now().Add(-rollupLookback)) {
+		requestRollup(createdAt)
+	}
+	return rows > 0, nil
+}
+
+// onMqttConnect runs on every (re)connect, subscriptions do not survive a reconnect
+func onMqttConnect(client mqtt.Client) {
+	publishServerOnline(client)
+	subscribeHomeAssistantStatus(client)
+	subscribeMeasurements(client)
+}
+
+// measurementTime is when the measurement was taken, or now when the reader did not say
+func measurementTime(m *MeasurementJson) time.Time {
+	if m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return time.Now()
+}
+
+// onMeasurementStored passes a newly stored measurement on to MQTT, stream clients and alert rules
+func onMeasurementStored(device model.Device, m *MeasurementJson) {
+	updateSensorMetrics(device, m)
+	markSeen(device, measurementTime(m))
+	trackBattery(device, m)
+	publishState(device, m)
+	publishStream(device, m)
+	checkAlerts(device, m)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics served from /metrics
+
+const (
+	RejectReasonInvalidPayload = "invalid_payload"
+	RejectReasonInvalidData    = "invalid_data"
+	RejectReasonMissingMac     = "missing_mac"
+	RejectReasonInvalidMac     = "invalid_mac"
+	RejectReasonInactiveDevice = "inactive_device"
+	RejectReasonQueueFull      = "queue_full"
+	RejectReasonImplausible    = "implausible"
+	RejectReasonUnwritable     = "unwritable"
+	RejectReasonUnknownLabel   = "unknown_label"
+)
+
+var (
+	sensorLabels = []string{"mac", "label"}
+
+	temperatureGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_temperature_celsius",
+		Help: "Latest temperature reading.",
+	}, sensorLabels)
+	humidityGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_humidity_percent",
+		Help: "Latest relative humidity reading.",
+	}, sensorLabels)
+	pressureGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_pressure_pascals",
+		Help: "Latest air pressure reading.",
+	}, sensorLabels)
+	batteryGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_battery_volts",
+		Help: "Latest battery voltage.",
+	}, sensorLabels)
+	rssiGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_rssi_dbm",
+		Help: "Latest received signal strength.",
+	}, sensorLabels)
+	movementCounterGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ruuvi_movement_counter",
+		Help: "Latest movement counter value reported by the tag.",
+	}, sensorLabels)
+
+	acceptedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_measurements_accepted_total",
+		Help: "Measurements accepted for a known device.",
+	})
+	rejectedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ruuvi_measurements_rejected_total",
+		Help: "Measurements rejected, by reason.",
+	}, []string{"reason"})
+	unknownMacCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_measurements_unknown_mac_total",
+		Help: "Measurements received from a MAC that is not an active device.",
+	})
+	violationCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ruuvi_validation_violations_total",
+		Help: "Violated validation rules of rejected measurements, by field and rule.",
+	}, []string{"field", "rule"})
+	dbErrorCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ruuvi_db_errors_total",
+		Help: "Failed database writes of measurements.",
+	})
+	storageErrorCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ruuvi_storage_errors_total",
+		Help: "Failed writes of measurements to secondary storage backends, by backend.",
+	}, []string{"backend"})
+	storageDroppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ruuvi_storage_dropped_total",
+		Help: "Measurements dropped because the queue of a secondary storage backend was full, by backend.",
+	}, []string{"backend"})
+	alertCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ruuvi_alerts_total",
+		Help: "Alerts that fired or resolved, by rule and status.",
+	}, []string{"rule", "status"})
+	notifyErrorCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ruuvi_notify_errors_total",
+		Help: "Alert notifications that could not be sent, by notifier.",
+	}, []string{"notifier"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ruuvi_spool_depth",
+		Help: "Measurements waiting in the spool for Postgres and MQTT.",
+	}, func() float64 {
+		if spool == nil {
+			return 0
+		}
+		return float64(spool.status().Depth)
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ruuvi_spool_oldest_age_seconds",
+		Help: "Age of the oldest measurement in the spool, 0 when it is empty.",
+	}, func() float64 {
+		if spool == nil {
+			return 0
+		}
+		return spool.status().AgeSeconds
+	})
+	mqttPublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ruuvi_mqtt_publish_duration_seconds",
+		Help:    "Time spent waiting for MQTT publishes, by whether the publish completed.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5},
+	}, []string{"published"})
+)
+
+func countRejected(reason string) {
+	rejectedCounter.WithLabelValues(reason).Inc()
+}
+
+func countQuarantineError(err error) {
+	switch {
+	case errors.Is(err, errInvalidMac):
+		countRejected(RejectReasonInvalidMac)
+	case errors.Is(err, errInactiveDevice):
+		countRejected(RejectReasonInactiveDevice)
+	default:
+		dbErrorCounter.Inc()
+	}
+}
+
+// updateSensorMetrics sets the gauges of the device from a stored measurement
+func updateSensorMetrics(device model.Device, m *MeasurementJson) {
+	labels := prometheus.Labels{"mac": strings.ToLower(device.Mac), "label": device.Label}
+
+	if m.Temperature != nil {
+		temperatureGauge.With(labels).Set(*m.Temperature)
+	}
+	if m.Humidity != nil {
+		humidityGauge.With(labels).Set(*m.Humidity)
+	}
+	if m.Pressure != nil {
+		pressureGauge.With(labels).Set(float64(*m.Pressure))
+	}
+	if m.Battery != nil {
+		batteryGauge.With(labels).Set(float64(*m.Battery) / 1000)
+	}
+	if m.Rssi != nil {
+		rssiGauge.With(labels).Set(float64(*m.Rssi))
+	}
+	if m.MovementCounter != nil {
+		movementCounterGauge.With(labels).Set(float64(*m.MovementCounter))
+	}
+}
+
+// deleteSensorMetrics drops the series of the device, e.g. when it is relabeled or retired
+func deleteSensorMetrics(device model.Device) {
+	labels := prometheus.Labels{"mac": strings.ToLower(device.Mac)}
+	for _, gauge := range []*prometheus.GaugeVec{temperatureGauge, humidityGauge, pressureGauge, batteryGauge, rssiGauge, movementCounterGauge} {
+		gauge.DeletePartialMatch(labels)
+	}
+}
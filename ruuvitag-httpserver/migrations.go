@@ -0,0 +1,191 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Versioned schema migrations. The files in migrations/ are embedded into the binary and applied in
+// order of their version, the number before the first underscore of the file name. Applied versions
+// are recorded in schema_migration. The go-jet models in .gen are generated from the migrated schema
+// with gen-models.sh.
+//
+// The first migrations create their tables only when missing, so that a database set up by hand from
+// the old schema file is taken over as it is.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock that keeps two servers from migrating at the same time
+const migrationLockID = 8_137_201
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+type appliedMigration struct {
+	version   int
+	name      string
+	appliedAt time.Time
+}
+
+// loadMigrations returns the embedded migrations ordered by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []migration{}
+	versions := map[int]string{}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !found || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must be named <version>_<name>.sql", entry.Name())
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, entry.Name())
+		}
+		versions[version] = entry.Name()
+
+		data, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+func createMigrationTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migration (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`)
+	return err
+}
+
+// appliedMigrations returns the recorded migrations by version
+func appliedMigrations() (map[int]appliedMigration, error) {
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_migration")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.version, &a.name, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[a.version] = a
+	}
+	return applied, rows.Err()
+}
+
+// migrate applies the migrations that have not been applied yet and returns how many were applied
+func migrate() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := createMigrationTable(); err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		done, err := applyMigration(m)
+		if err != nil {
+			return count, fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		if done {
+			log.Info().Msgf("Applied migration %s", m.name)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// applyMigration runs the migration and records it in one transaction. It returns false when another
+// server applied the migration while this one waited for the lock.
+func applyMigration(m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return false, err
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migration WHERE version = $1)", m.version).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(m.sql); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migration (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// migrateOnStartup applies pending migrations before the server starts, unless MIGRATE_ON_STARTUP is false
+func migrateOnStartup() {
+	if envFile["MIGRATE_ON_STARTUP"] == "false" {
+		log.Info().Msg("Not migrating the database on startup, run the migrate command to apply migrations")
+		return
+	}
+	count, err := migrate()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to migrate the database")
+		panic(err)
+	}
+	if count == 0 {
+		log.Info().Msg("Database schema is up to date")
+	}
+}
+
+// migrationStatus returns the embedded migrations and the ones of them that have been applied
+func migrationStatus() ([]migration, map[int]appliedMigration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := createMigrationTable(); err != nil {
+		return nil, nil, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrations, applied, nil
+}
@@ -0,0 +1,26 @@
+-- Device status, and quarantine for the readings of pending devices until they are approved
+
+ALTER TABLE device ADD COLUMN IF NOT EXISTS status VARCHAR NOT NULL DEFAULT 'active';
+ALTER TABLE device ADD COLUMN IF NOT EXISTS first_seen TIMESTAMP WITH TIME ZONE;
+ALTER TABLE device ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP WITH TIME ZONE;
+ALTER TABLE device ADD COLUMN IF NOT EXISTS rssi INTEGER;
+
+CREATE TABLE IF NOT EXISTS quarantined_measurement (
+    id SERIAL PRIMARY KEY,
+    device_id INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    temperature NUMERIC(5,2),
+    humidity NUMERIC(5,2),
+    pressure INTEGER,
+    acceleration_x INTEGER,
+    acceleration_y INTEGER,
+    acceleration_z INTEGER,
+    battery_voltage INTEGER,
+    tx_power INTEGER,
+    movement_counter BIGINT,
+    measurement_sequence_number BIGINT,
+    rssi INTEGER,
+    CONSTRAINT fk_device
+        FOREIGN KEY(device_id)
+        REFERENCES device(id)
+);
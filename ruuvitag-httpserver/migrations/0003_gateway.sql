@@ -0,0 +1,4 @@
+-- The gateway or reader that relayed each reading
+
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS gateway VARCHAR;
+ALTER TABLE quarantined_measurement ADD COLUMN IF NOT EXISTS gateway VARCHAR;
@@ -0,0 +1,7 @@
+-- Events forwarded by the Ruuvi Station app, kept to skip events that are forwarded again
+
+CREATE TABLE IF NOT EXISTS station_event (
+    event_id VARCHAR PRIMARY KEY,
+    station_id VARCHAR,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
@@ -0,0 +1,14 @@
+-- API tokens of readers, gateways and admins. Only the SHA-256 of the token is stored.
+
+CREATE TABLE IF NOT EXISTS api_token (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR NOT NULL,
+    scope VARCHAR NOT NULL,
+    token_hash VARCHAR NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+-- A reader keeps its name when its token is rotated
+CREATE UNIQUE INDEX IF NOT EXISTS api_token_active_name ON api_token (name) WHERE revoked_at IS NULL;
@@ -0,0 +1,9 @@
+-- Readings that failed plausibility validation, kept for inspection when validation.storeRejected is set
+
+CREATE TABLE IF NOT EXISTS rejected_measurement (
+    id SERIAL PRIMARY KEY,
+    mac VARCHAR,
+    received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    measurement JSONB NOT NULL,
+    violations JSONB NOT NULL
+);
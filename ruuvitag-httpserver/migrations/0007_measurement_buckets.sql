@@ -0,0 +1,13 @@
+-- One row per device and bucket, measurements are upserted on the unique index
+
+-- Number of readings merged into the row
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS sample_count INTEGER NOT NULL DEFAULT 1;
+
+-- Concurrent requests could store the same minute twice before, keep the first row
+DELETE FROM measurement duplicate
+    USING measurement first
+    WHERE duplicate.device_id = first.device_id
+        AND duplicate.created_at = first.created_at
+        AND duplicate.id > first.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS measurement_device_created_at ON measurement (device_id, created_at);
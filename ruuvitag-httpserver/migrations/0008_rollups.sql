@@ -0,0 +1,61 @@
+-- Hourly and daily min/max/avg/last rollups of measurement, in buckets aligned to the Unix epoch
+
+CREATE TABLE IF NOT EXISTS measurement_hourly (
+    device_id INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    sample_count INTEGER NOT NULL,
+    temperature_min DOUBLE PRECISION,
+    temperature_max DOUBLE PRECISION,
+    temperature_avg DOUBLE PRECISION,
+    temperature_last DOUBLE PRECISION,
+    humidity_min DOUBLE PRECISION,
+    humidity_max DOUBLE PRECISION,
+    humidity_avg DOUBLE PRECISION,
+    humidity_last DOUBLE PRECISION,
+    pressure_min DOUBLE PRECISION,
+    pressure_max DOUBLE PRECISION,
+    pressure_avg DOUBLE PRECISION,
+    pressure_last DOUBLE PRECISION,
+    battery_min DOUBLE PRECISION,
+    battery_max DOUBLE PRECISION,
+    battery_avg DOUBLE PRECISION,
+    battery_last DOUBLE PRECISION,
+    rssi_min DOUBLE PRECISION,
+    rssi_max DOUBLE PRECISION,
+    rssi_avg DOUBLE PRECISION,
+    rssi_last DOUBLE PRECISION,
+    PRIMARY KEY (device_id, created_at),
+    CONSTRAINT fk_device
+        FOREIGN KEY(device_id)
+        REFERENCES device(id)
+);
+
+CREATE TABLE IF NOT EXISTS measurement_daily (
+    device_id INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    sample_count INTEGER NOT NULL,
+    temperature_min DOUBLE PRECISION,
+    temperature_max DOUBLE PRECISION,
+    temperature_avg DOUBLE PRECISION,
+    temperature_last DOUBLE PRECISION,
+    humidity_min DOUBLE PRECISION,
+    humidity_max DOUBLE PRECISION,
+    humidity_avg DOUBLE PRECISION,
+    humidity_last DOUBLE PRECISION,
+    pressure_min DOUBLE PRECISION,
+    pressure_max DOUBLE PRECISION,
+    pressure_avg DOUBLE PRECISION,
+    pressure_last DOUBLE PRECISION,
+    battery_min DOUBLE PRECISION,
+    battery_max DOUBLE PRECISION,
+    battery_avg DOUBLE PRECISION,
+    battery_last DOUBLE PRECISION,
+    rssi_min DOUBLE PRECISION,
+    rssi_max DOUBLE PRECISION,
+    rssi_avg DOUBLE PRECISION,
+    rssi_last DOUBLE PRECISION,
+    PRIMARY KEY (device_id, created_at),
+    CONSTRAINT fk_device
+        FOREIGN KEY(device_id)
+        REFERENCES device(id)
+);
@@ -0,0 +1,21 @@
+-- Servers keep their device caches current by listening to device_changed. Changes of the seen times
+-- and RSSI of pending devices are not of interest and do not notify.
+
+CREATE OR REPLACE FUNCTION notify_device_changed() RETURNS trigger AS $$
+DECLARE
+    changed device;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+    ELSE
+        changed := NEW;
+    END IF;
+    PERFORM pg_notify('device_changed', json_build_object('op', TG_OP, 'id', changed.id, 'mac', changed.mac)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS device_changed ON device;
+CREATE TRIGGER device_changed
+    AFTER INSERT OR DELETE OR UPDATE OF mac, label, status ON device
+    FOR EACH ROW EXECUTE FUNCTION notify_device_changed();
@@ -0,0 +1,19 @@
+-- Alerts of the rules in config.yml, one row from firing until resolved
+
+CREATE TABLE IF NOT EXISTS alert (
+    id SERIAL PRIMARY KEY,
+    rule VARCHAR NOT NULL,
+    device_id INT NOT NULL,
+    field VARCHAR NOT NULL,
+    status VARCHAR NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    threshold DOUBLE PRECISION NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    CONSTRAINT fk_device
+        FOREIGN KEY(device_id)
+        REFERENCES device(id)
+);
+
+-- A rule fires at most once per device at a time
+CREATE UNIQUE INDEX IF NOT EXISTS alert_firing ON alert (rule, device_id) WHERE status = 'firing';
@@ -0,0 +1,16 @@
+-- Periods in which a device did not report, from its last reading before the silence until the first one
+-- after it. ended_at is NULL while the device is still silent.
+
+CREATE TABLE IF NOT EXISTS sensor_gap (
+    id SERIAL PRIMARY KEY,
+    device_id INT NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ended_at TIMESTAMP WITH TIME ZONE,
+    CONSTRAINT fk_device
+        FOREIGN KEY(device_id)
+        REFERENCES device(id)
+);
+
+-- A device has at most one open gap
+CREATE UNIQUE INDEX IF NOT EXISTS sensor_gap_open ON sensor_gap (device_id) WHERE ended_at IS NULL;
+CREATE INDEX IF NOT EXISTS sensor_gap_device_started_at ON sensor_gap (device_id, started_at);
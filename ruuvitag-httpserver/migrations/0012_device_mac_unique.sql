@@ -0,0 +1,20 @@
+-- One device per MAC in any case, pending devices are registered with an upsert on the unique index
+
+-- Concurrent first readings could register a pending device twice before, move the quarantined readings
+-- of the duplicates to the first device and remove them
+UPDATE quarantined_measurement
+    SET device_id = first.id
+    FROM device duplicate, device first
+    WHERE quarantined_measurement.device_id = duplicate.id
+        AND lower(duplicate.mac) = lower(first.mac)
+        AND duplicate.id > first.id
+        AND duplicate.status = 'pending'
+        AND NOT EXISTS (SELECT 1 FROM device earlier WHERE lower(earlier.mac) = lower(first.mac) AND earlier.id < first.id);
+
+DELETE FROM device duplicate
+    USING device first
+    WHERE lower(duplicate.mac) = lower(first.mac)
+        AND duplicate.id > first.id
+        AND duplicate.status = 'pending';
+
+CREATE UNIQUE INDEX IF NOT EXISTS device_mac ON device (lower(mac));
@@ -0,0 +1,3 @@
+-- The retention job deletes measurements by created_at across all devices
+
+CREATE INDEX IF NOT EXISTS measurement_created_at ON measurement (created_at);
@@ -0,0 +1,11 @@
+-- Number of readings behind each averaged value of a row, readings of a bucket may lack some fields.
+-- NULL in rows from before, their values count every sample of the row.
+
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS temperature_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS humidity_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS pressure_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS acceleration_x_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS acceleration_y_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS acceleration_z_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS battery_voltage_count INTEGER;
+ALTER TABLE measurement ADD COLUMN IF NOT EXISTS rssi_count INTEGER;
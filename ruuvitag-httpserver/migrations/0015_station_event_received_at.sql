@@ -0,0 +1,3 @@
+-- Station events are deleted by the retention job once they are too old to be forwarded again
+
+CREATE INDEX IF NOT EXISTS station_event_received_at ON station_event (received_at);
@@ -0,0 +1,13 @@
+-- Servers keep their token caches current by listening to api_token_changed. Uses of a token do not notify.
+
+CREATE OR REPLACE FUNCTION notify_api_token_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('api_token_changed', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS api_token_changed ON api_token;
+CREATE TRIGGER api_token_changed
+    AFTER INSERT OR DELETE OR UPDATE OF scope, token_hash, revoked_at ON api_token
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_api_token_changed();
@@ -0,0 +1,14 @@
+-- Number of readings behind each averaged value of a rollup, readings of a bucket may lack some fields.
+-- NULL in rows from before, their averages count every sample of the row.
+
+ALTER TABLE measurement_hourly ADD COLUMN IF NOT EXISTS temperature_count INTEGER;
+ALTER TABLE measurement_hourly ADD COLUMN IF NOT EXISTS humidity_count INTEGER;
+ALTER TABLE measurement_hourly ADD COLUMN IF NOT EXISTS pressure_count INTEGER;
+ALTER TABLE measurement_hourly ADD COLUMN IF NOT EXISTS battery_count INTEGER;
+ALTER TABLE measurement_hourly ADD COLUMN IF NOT EXISTS rssi_count INTEGER;
+
+ALTER TABLE measurement_daily ADD COLUMN IF NOT EXISTS temperature_count INTEGER;
+ALTER TABLE measurement_daily ADD COLUMN IF NOT EXISTS humidity_count INTEGER;
+ALTER TABLE measurement_daily ADD COLUMN IF NOT EXISTS pressure_count INTEGER;
+ALTER TABLE measurement_daily ADD COLUMN IF NOT EXISTS battery_count INTEGER;
+ALTER TABLE measurement_daily ADD COLUMN IF NOT EXISTS rssi_count INTEGER;
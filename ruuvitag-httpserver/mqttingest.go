@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+// Measurements over MQTT. Topics are expected to end with the MAC of the tag, e.g. ruuvi/<gateway>/<mac>,
+// and payloads are either MeasurementJson, the JSON of the Ruuvi Gateway or Ruuvi manufacturer data as a hex string.
+
+const mqttIngestBufferSize = 256
+
+var errMissingMac = errors.New("no mac in payload or topic")
+
+// mqttGatewayJson is what the Ruuvi Gateway publishes for each tag
+// https://docs.ruuvi.com/gw-data-formats/mqtt-time-stamped-data-from-bluetooth-sensors
+type mqttGatewayJson struct {
+	GatewayMac string           `json:"gw_mac"`
+	Rssi       *int32           `json:"rssi"`
+	Timestamp  gatewayTimestamp `json:"ts"`
+	Data       string           `json:"data"`
+}
+
+type mqttMeasurement struct {
+	topic   string
+	payload []byte
+}
+
+var mqttIngestQueue = make(chan mqttMeasurement, mqttIngestBufferSize)
+
+// subscribeMeasurements subscribes to MQTT_INGEST_TOPIC when it is configured
+func subscribeMeasurements(client mqtt.Client) {
+	topic := envFile["MQTT_INGEST_TOPIC"]
+	if topic == "" {
+		return
+	}
+
+	token := client.Subscribe(topic, 1, func(_ mqtt.Client, message mqtt.Message) {
+		// Storing publishes to MQTT and waits for it, which must not happen in the message handler
+		select {
+		case mqttIngestQueue <- mqttMeasurement{topic: message.Topic(), payload: message.Payload()}:
+		default:
+			countRejected(RejectReasonQueueFull)
+			log.Error().Msgf("MQTT ingest queue is full, dropping message from %s", message.Topic())
+		}
+	})
+	if token.WaitTimeout(2*time.Second) && token.Error() == nil {
+		log.Info().Msgf("Subscribed to %s", topic)
+	} else {
+		log.Error().Err(token.Error()).Msgf("Failed to subscribe to %s", topic)
+	}
+}
+
+// ingestMqttMeasurements stores the measurements received over MQTT in the order they arrived
+func ingestMqttMeasurements() {
+	for message := range mqttIngestQueue {
+		m, err := decodeMqttMeasurement(message.topic, message.payload)
+		if err != nil {
+			if errors.Is(err, errMissingMac) {
+				countRejected(RejectReasonMissingMac)
+			} else {
+				countRejected(RejectReasonInvalidData)
+			}
+			log.Error().Err(err).Msgf("Failed to decode measurement from %s", message.topic)
+			continue
+		}
+		log.Info().Msgf("Received new measurement over MQTT: %v", m)
+
+		if err := storeMeasurement(m); err != nil {
+			log.Error().Err(err).Msgf("Failed to write data from %s", message.topic)
+		}
+	}
+}
+
+func decodeMqttMeasurement(topic string, payload []byte) (*MeasurementJson, error) {
+	payload = bytes.TrimSpace(payload)
+
+	var m *MeasurementJson
+	if bytes.HasPrefix(payload, []byte("{")) {
+		g := new(mqttGatewayJson)
+		if err := json.Unmarshal(payload, g); err != nil {
+			return nil, err
+		}
+		if g.Data != "" {
+			tag := RuuviGatewayTag{Rssi: g.Rssi, Timestamp: g.Timestamp, Data: g.Data}
+			var err error
+			if m, err = decodeGatewayTag(topicMac(topic), tag, g.GatewayMac); err != nil {
+				return nil, err
+			}
+		} else {
+			m = new(MeasurementJson)
+			if err := json.Unmarshal(payload, m); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		data, err := hex.DecodeString(string(payload))
+		if err != nil {
+			return nil, fmt.Errorf("payload is neither JSON nor hex: %w", err)
+		}
+		if m, err = decodeManufacturerData(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.MAC == "" {
+		m.MAC = topicMac(topic)
+	}
+	if m.MAC == "" {
+		return nil, errMissingMac
+	}
+	return m, nil
+}
+
+// topicMac returns the MAC from the last level of the topic, given either with or without separators
+func topicMac(topic string) string {
+	levels := strings.Split(topic, "/")
+	last := levels[len(levels)-1]
+	if len(last) == 12 {
+		if _, err := hex.DecodeString(last); err == nil {
+			parts := []string{}
+			for i := 0; i < 12; i += 2 {
+				parts = append(parts, last[i:i+2])
+			}
+			last = strings.Join(parts, ":")
+		}
+	}
+	if mac, err := normalizeMac(last); err == nil {
+		return mac
+	}
+	return ""
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog/log"
+)
+
+// Notifiers send alerts out. Every notifier has a queue of its own and retries failed notifications, so
+// that a slow or unavailable one holds up neither the alert worker, the watchdog nor the other notifiers.
+// Every notifier can be pointed at a local stand-in, e.g. the ones in docker-compose.notifiers.yml, and
+// tried with ruuvitag-httpserver alerts test.
+
+const (
+	NotifierTypeWebhook = "webhook"
+	NotifierTypeMqtt    = "mqtt"
+	NotifierTypeSMTP    = "smtp"
+	NotifierTypeNtfy    = "ntfy"
+
+	notifyTimeout    = 10 * time.Second
+	notifyQueueSize  = 100
+	notifyAttempts   = 3
+	notifyRetryDelay = 30 * time.Second
+)
+
+type NotifierConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// URL of the webhook or of the ntfy topic
+	URL string `yaml:"url"`
+	// Headers are added to webhook requests
+	Headers map[string]string `yaml:"headers"`
+	// TokenEnv is the .env variable with the bearer token of the webhook or ntfy
+	TokenEnv string `yaml:"tokenEnv"`
+
+	// Topic that MQTT notifications are published to
+	Topic string `yaml:"topic"`
+
+	// Host and Port of the SMTP server, Port 25 by default
+	Host string   `yaml:"host"`
+	Port int      `yaml:"port"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+	// Username and the .env variable with the password, no authentication without a username
+	Username    string `yaml:"username"`
+	PasswordEnv string `yaml:"passwordEnv"`
+}
+
+// Notification is what notifiers send, webhooks and MQTT get it as JSON
+type Notification struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	AlertJson
+}
+
+// Notifier sends notifications to one channel
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+func checkNotifierConfig(c NotifierConfig) error {
+	if c.Name == "" {
+		return fmt.Errorf("notifier without a name")
+	}
+	switch c.Type {
+	case NotifierTypeWebhook, NotifierTypeNtfy:
+		if c.URL == "" {
+			return fmt.Errorf("notifier %s: url is missing", c.Name)
+		}
+	case NotifierTypeMqtt:
+		if c.Topic == "" {
+			return fmt.Errorf("notifier %s: topic is missing", c.Name)
+		}
+	case NotifierTypeSMTP:
+		if c.Host == "" || c.From == "" || len(c.To) == 0 {
+			return fmt.Errorf("notifier %s: host, from and to are needed", c.Name)
+		}
+	default:
+		return fmt.Errorf("notifier %s: unknown type %s, use %s, %s, %s or %s", c.Name, c.Type,
+			NotifierTypeWebhook, NotifierTypeMqtt, NotifierTypeSMTP, NotifierTypeNtfy)
+	}
+	return nil
+}
+
+// notifierQueues by notifier name, see startNotifiers
+var notifierQueues = map[string]chan Notification{}
+
+// newNotifier returns the notifier of the config, MQTT notifiers publish with the given client
+func newNotifier(c NotifierConfig, client mqtt.Client) Notifier {
+	httpClient := &http.Client{Timeout: notifyTimeout}
+	switch c.Type {
+	case NotifierTypeWebhook:
+		return webhookNotifier{url: c.URL, headers: c.Headers, token: envFile[c.TokenEnv], client: httpClient}
+	case NotifierTypeNtfy:
+		return ntfyNotifier{url: c.URL, token: envFile[c.TokenEnv], client: httpClient}
+	case NotifierTypeMqtt:
+		return mqttNotifier{topic: c.Topic, client: client}
+	default:
+		port := c.Port
+		if port == 0 {
+			port = 25
+		}
+		return smtpNotifier{address: c.Host + ":" + strconv.Itoa(port), host: c.Host, from: c.From, to: c.To,
+			username: c.Username, password: envFile[c.PasswordEnv]}
+	}
+}
+
+func newNotification(rule AlertRule, device model.Device, alert model.Alert) Notification {
+	n := Notification{AlertJson: toAlertJson(alert, device)}
+	name := device.Label
+	if name == "" {
+		name = device.Mac
+	}
+
+	if rule.Name == staleAlertRule {
+		silence := time.Duration(alert.Value) * time.Second
+		if alert.Status == AlertStatusResolved {
+			n.Title = fmt.Sprintf("Reporting again: %s", name)
+			n.Message = fmt.Sprintf("%s reported again after %s of silence", name, silence)
+		} else {
+			n.Title = fmt.Sprintf("Stale: %s", name)
+			n.Message = fmt.Sprintf("%s has not reported for %s", name, silence)
+		}
+		return n
+	}
+	if alert.Status == AlertStatusResolved {
+		n.Title = fmt.Sprintf("Resolved: %s", rule.Name)
+		after := alert.ResolvedAt.Sub(alert.StartedAt).Round(time.Second)
+		if rule.MaxRatePerMinute != nil {
+			n.Message = fmt.Sprintf("%s %s changes %.2f per minute again after %s", name, rule.Field, alert.Value, after)
+		} else {
+			n.Message = fmt.Sprintf("%s %s is back at %g after %s", name, rule.Field, alert.Value, after)
+		}
+		return n
+	}
+	n.Title = fmt.Sprintf("Firing: %s", rule.Name)
+	switch {
+	case rule.Above != nil:
+		n.Message = fmt.Sprintf("%s %s is %g, above %g", name, rule.Field, alert.Value, alert.Threshold)
+	case rule.Below != nil:
+		n.Message = fmt.Sprintf("%s %s is %g, below %g", name, rule.Field, alert.Value, alert.Threshold)
+	default:
+		n.Message = fmt.Sprintf("%s %s changes %.2f per minute, more than %g", name, rule.Field, alert.Value, alert.Threshold)
+	}
+	if rule.For > 0 {
+		n.Message += fmt.Sprintf(" for %s", rule.For)
+	}
+	return n
+}
+
+// startNotifiers starts the queues of the configured notifiers, MQTT notifiers publish with mqttClient
+func startNotifiers() {
+	for _, c := range config.Alerts.Notifiers {
+		queue := make(chan Notification, notifyQueueSize)
+		notifierQueues[c.Name] = queue
+		go runNotifier(c.Name, newNotifier(c, mqttClient), queue)
+	}
+}
+
+// runNotifier sends the queued notifications in order, retrying each a few times before giving up on it
+func runNotifier(name string, notifier Notifier, queue chan Notification) {
+	for n := range queue {
+		for attempt := 1; ; attempt++ {
+			err := notifier.Notify(n)
+			if err == nil {
+				break
+			}
+			if attempt == notifyAttempts {
+				notifyErrorCounter.WithLabelValues(name).Inc()
+				log.Error().Err(err).Msgf("Failed to notify %s of %s, giving up after %d attempts", name, n.Rule, attempt)
+				break
+			}
+			delay := notifyRetryDelay * time.Duration(attempt)
+			log.Warn().Err(err).Msgf("Failed to notify %s of %s, retrying in %s", name, n.Rule, delay)
+			time.Sleep(delay)
+		}
+	}
+}
+
+// notifyAlert queues the notification for the notifiers of the rule
+func notifyAlert(rule AlertRule, n Notification) {
+	for _, c := range config.Alerts.Notifiers {
+		if len(rule.Notify) > 0 && !slices.Contains(rule.Notify, c.Name) {
+			continue
+		}
+		select {
+		case notifierQueues[c.Name] <- n:
+		default:
+			notifyErrorCounter.WithLabelValues(c.Name).Inc()
+			log.Error().Msgf("Queue of notifier %s is full, dropping notification of %s", c.Name, rule.Name)
+		}
+	}
+}
+
+// sendTestNotification sends a made up alert to the named notifier, or to all notifiers when name is
+// empty, and returns how many were notified. MQTT notifiers get a connection of their own.
+func sendTestNotification(name string) (int, error) {
+	notifiers := []NotifierConfig{}
+	for _, c := range config.Alerts.Notifiers {
+		if name == "" || c.Name == name {
+			notifiers = append(notifiers, c)
+		}
+	}
+	if len(notifiers) == 0 {
+		return 0, fmt.Errorf("no notifier %s in %s", name, configPath)
+	}
+
+	var client mqtt.Client
+	for _, c := range notifiers {
+		if c.Type == NotifierTypeMqtt && client == nil {
+			opts := mqtt.NewClientOptions().
+				AddBroker(envFile["MQTT_BROKER"]).
+				SetClientID("ruuvitag-httpserver-alerts-test").
+				SetUsername(envFile["MQTT_USER_NAME"]).
+				SetPassword(envFile["MQTT_USER_PASSWORD"])
+			client = mqtt.NewClient(opts)
+			if token := client.Connect(); token.Wait() && token.Error() != nil {
+				return 0, fmt.Errorf("MQTT connection error: %w", token.Error())
+			}
+			defer client.Disconnect(250)
+		}
+	}
+
+	limit := 30.0
+	rule := AlertRule{Name: "test", Field: "temperature", Above: &limit}
+	device := model.Device{Mac: "00:00:00:00:00:00", Label: "Test sensor"}
+	alert := model.Alert{Rule: rule.Name, Field: rule.Field, Status: AlertStatusFiring, Value: 31.5,
+		Threshold: limit, StartedAt: time.Now()}
+	n := newNotification(rule, device, alert)
+	for _, c := range notifiers {
+		if err := newNotifier(c, client).Notify(n); err != nil {
+			return 0, fmt.Errorf("%s: %w", c.Name, err)
+		}
+	}
+	return len(notifiers), nil
+}
+
+// postNotification posts the body and fails on responses other than 2xx
+func postNotification(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s responded %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// webhookNotifier posts the notification as JSON
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+	token   string
+	client  *http.Client
+}
+
+func (w webhookNotifier) Notify(n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	return postNotification(w.client, req)
+}
+
+// ntfyNotifier publishes to a ntfy topic, https://docs.ntfy.sh/publish/
+type ntfyNotifier struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (nt ntfyNotifier) Notify(n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, nt.url, strings.NewReader(n.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title)
+	if n.Status == AlertStatusFiring {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	} else {
+		req.Header.Set("Tags", "white_check_mark")
+	}
+	if nt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+nt.token)
+	}
+	return postNotification(nt.client, req)
+}
+
+// mqttNotifier publishes the notification as JSON
+type mqttNotifier struct {
+	topic  string
+	client mqtt.Client
+}
+
+func (mn mqttNotifier) Notify(n Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	token := mn.client.Publish(mn.topic, 1, false, data)
+	if !token.WaitTimeout(notifyTimeout) {
+		return fmt.Errorf("publishing to %s timed out", mn.topic)
+	}
+	return token.Error()
+}
+
+// smtpNotifier sends the notification as plain text email. STARTTLS is used when the server offers it.
+// Unlike smtp.SendMail the whole conversation has to finish within notifyTimeout.
+type smtpNotifier struct {
+	address  string
+	host     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (s smtpNotifier) Notify(n Notification) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	return s.sendMail(auth, []byte(s.message(n, time.Now())))
+}
+
+// message returns the email of the notification. The subject carries rule and device labels, it is encoded
+// so that non-ASCII characters and line breaks in them cannot break the headers.
+func (s smtpNotifier) message(n Notification, date time.Time) string {
+	return fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		s.from, strings.Join(s.to, ", "), mime.QEncoding.Encode("utf-8", n.Title), date.Format(time.RFC1123Z), n.Message)
+}
+
+// sendMail is smtp.SendMail with a deadline on the connection
+func (s smtpNotifier) sendMail(auth smtp.Auth, message []byte) error {
+	conn, err := net.DialTimeout("tcp", s.address, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(notifyTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Unknown tags are registered as pending devices and their readings are kept in quarantine
+// until an admin approves the device.
+
+type ApproveDeviceJson struct {
+	Label string `json:"label"`
+	// Backfill moves the quarantined readings into storage, otherwise they are discarded
+	Backfill bool `json:"backfill"`
+}
+
+// quarantineMeasurement registers the MAC as a pending device when it is seen for the first time
+// and keeps the reading in quarantine
+func quarantineMeasurement(db qrm.DB, m *MeasurementJson) error {
+	mac, err := normalizeMac(m.MAC)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// Concurrent first readings of the MAC race to register it, the unique index on lower(mac) lets one win
+	device := model.Device{
+		Mac:       mac,
+		Status:    DeviceStatusPending,
+		FirstSeen: &now,
+		LastSeen:  &now,
+		Rssi:      m.Rssi,
+	}
+	registerStmt := Device.INSERT(Device.MutableColumns).
+		MODEL(device).
+		ON_CONFLICT().DO_NOTHING().
+		RETURNING(Device.AllColumns)
+	err = registerStmt.Query(db, &device)
+	switch {
+	case err == nil:
+		log.Info().Msgf("Discovered unknown mac %s, added it as pending device", mac)
+	case !errors.Is(err, qrm.ErrNoRows):
+		return err
+	default:
+		selectStmt := SELECT(Device.AllColumns).FROM(Device).WHERE(LOWER(Device.Mac).EQ(String(mac)))
+		if err := selectStmt.Query(db, &device); err != nil {
+			return err
+		}
+		if device.Status != DeviceStatusPending {
+			log.Warn().Msgf("Device %s is %s, skipping writing data to Postgresql", mac, device.Status)
+			return fmt.Errorf("%w: %s is %s, skipping writing data to Postgresql", errInactiveDevice, mac, device.Status)
+		}
+		device.LastSeen = &now
+		if m.Rssi != nil {
+			device.Rssi = m.Rssi
+		}
+		updateStmt := Device.UPDATE(Device.LastSeen, Device.Rssi).
+			MODEL(device).
+			WHERE(Device.ID.EQ(Int32(device.ID)))
+		if _, err := updateStmt.Exec(db); err != nil {
+			return err
+		}
+	}
+
+	createdAt := now
+	if m.Timestamp != nil {
+		createdAt = *m.Timestamp
+	}
+	measurement := model.QuarantinedMeasurement{
+		DeviceID:                  device.ID,
+		CreatedAt:                 createdAt,
+		Temperature:               m.Temperature,
+		Humidity:                  m.Humidity,
+		Pressure:                  m.Pressure,
+		AccelerationX:             m.AccelerationX,
+		AccelerationY:             m.AccelerationY,
+		AccelerationZ:             m.AccelerationZ,
+		BatteryVoltage:            m.Battery,
+		TxPower:                   m.TxPower,
+		MovementCounter:           m.MovementCounter,
+		MeasurementSequenceNumber: m.MeasurementSequenceNumber,
+		Rssi:                      m.Rssi,
+		Gateway:                   m.Gateway,
+	}
+	insertStmt := QuarantinedMeasurement.
+		INSERT(QuarantinedMeasurement.MutableColumns).
+		MODEL(measurement)
+	_, err = insertStmt.Exec(db)
+	return err
+}
+
+// approveDevice activates a pending device. With backfill the quarantined readings are moved into
+// storage, bucketed and merged the same way as storeMeasurement would have written them.
+func approveDevice(device model.Device, label string, backfill bool) (model.Device, int64, error) {
+	var backfilled int64
+	var measurements []*MeasurementJson
+
+	tx, err := db.Begin()
+	if err != nil {
+		return device, 0, err
+	}
+	defer tx.Rollback()
+
+	updateStmt := Device.UPDATE(Device.Label, Device.Status).
+		SET(String(label), String(DeviceStatusActive)).
+		WHERE(Device.ID.EQ(Int32(device.ID))).
+		RETURNING(Device.AllColumns)
+	if err := updateStmt.Query(tx, &device); err != nil {
+		return device, 0, err
+	}
+
+	if backfill {
+		var quarantined []model.QuarantinedMeasurement
+		selectStmt := SELECT(QuarantinedMeasurement.AllColumns).
+			FROM(QuarantinedMeasurement).
+			WHERE(QuarantinedMeasurement.DeviceID.EQ(Int32(device.ID))).
+			ORDER_BY(QuarantinedMeasurement.CreatedAt.ASC(), QuarantinedMeasurement.ID.ASC())
+		if err := selectStmt.Query(tx, &quarantined); err != nil {
+			return device, 0, err
+		}
+		for _, q := range quarantined {
+			m := quarantinedToMeasurement(device, q)
+			written, err := writePrimary(tx, device, m)
+			if err != nil {
+				return device, 0, err
+			}
+			measurements = append(measurements, m)
+			if written {
+				backfilled++
+			}
+		}
+	}
+
+	deleteStmt := QuarantinedMeasurement.DELETE().WHERE(QuarantinedMeasurement.DeviceID.EQ(Int32(device.ID)))
+	if _, err := deleteStmt.Exec(tx); err != nil {
+		return device, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return device, 0, err
+	}
+	log.Info().Msgf("Approved device %s as %s, backfilled %d measurements", device.Mac, device.Label, backfilled)
+
+	cacheDevice(device)
+	for _, m := range measurements {
+		fanOut(device, m)
+	}
+	return device, backfilled, nil
+}
+
+func quarantinedToMeasurement(device model.Device, q model.QuarantinedMeasurement) *MeasurementJson {
+	createdAt := q.CreatedAt
+	return &MeasurementJson{
+		MAC:                       device.Mac,
+		Temperature:               q.Temperature,
+		Humidity:                  q.Humidity,
+		Pressure:                  q.Pressure,
+		AccelerationX:             q.AccelerationX,
+		AccelerationY:             q.AccelerationY,
+		AccelerationZ:             q.AccelerationZ,
+		Battery:                   q.BatteryVoltage,
+		TxPower:                   q.TxPower,
+		MovementCounter:           q.MovementCounter,
+		MeasurementSequenceNumber: q.MeasurementSequenceNumber,
+		Rssi:                      q.Rssi,
+		Gateway:                   q.Gateway,
+		Timestamp:                 &createdAt,
+	}
+}
+
+func postApproveDevice(c echo.Context) error {
+	mac, err := normalizeMac(c.Param("mac"))
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+	a := new(ApproveDeviceJson)
+	if err := c.Bind(a); err != nil {
+		log.Error().Err(err).Msgf("Failed to bind payload into approval")
+		return echo.NewHTTPError(400, "Invalid data")
+	}
+	if strings.TrimSpace(a.Label) == "" {
+		return echo.NewHTTPError(400, "Invalid data: label is required")
+	}
+	if err := loadDevices(); err != nil {
+		return echo.NewHTTPError(500, "Failed to read devices")
+	}
+
+	device, err := selectDevice(mac)
+	if errors.Is(err, qrm.ErrNoRows) {
+		return echo.NewHTTPError(404, "Device not found")
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to select device %s", mac)
+		return echo.NewHTTPError(500, "Failed to read device")
+	}
+	if device.Status != DeviceStatusPending {
+		return echo.NewHTTPError(409, fmt.Sprintf("Device %s is not pending", mac))
+	}
+
+	device, backfilled, err := approveDevice(device, a.Label, a.Backfill)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to approve device %s", mac)
+		return echo.NewHTTPError(500, "Failed to write device")
+	}
+
+	return c.JSON(200, map[string]any{
+		"device":     toDeviceJson(device),
+		"backfilled": backfilled,
+	})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AggregateMin  = "min"
+	AggregateMax  = "max"
+	AggregateAvg  = "avg"
+	AggregateLast = "last"
+
+	defaultQueryPeriod = 24 * time.Hour
+	defaultBucket      = time.Hour
+	maxBucketsInQuery  = 10000
+)
+
+var (
+	// queryFields maps the field names of the query API to measurement columns
+	queryFields = map[string]Column{
+		"temperature": Measurement.Temperature,
+		"humidity":    Measurement.Humidity,
+		"pressure":    Measurement.Pressure,
+		"battery":     Measurement.BatteryVoltage,
+		"rssi":        Measurement.Rssi,
+	}
+	queryAggregates = []string{AggregateMin, AggregateMax, AggregateAvg, AggregateLast}
+)
+
+// MeasurementQuery selects time bucketed aggregates of stored measurements
+type MeasurementQuery struct {
+	// Device is a MAC address or a label, empty for all devices
+	Device     string
+	From       time.Time
+	To         time.Time
+	Bucket     time.Duration
+	Fields     []string
+	Aggregates []string
+}
+
+// Columns returns the names of the value columns in the order they are in MeasurementRow.Values
+func (q MeasurementQuery) Columns() []string {
+	columns := []string{}
+	for _, field := range q.Fields {
+		for _, aggregate := range q.Aggregates {
+			columns = append(columns, field+"_"+aggregate)
+		}
+	}
+	return columns
+}
+
+type MeasurementRow struct {
+	MAC    string
+	Label  string
+	Time   time.Time
+	Values []*float64
+}
+
+func parseMeasurementQuery(c echo.Context) (MeasurementQuery, error) {
+	q := MeasurementQuery{
+		Device:     c.QueryParam("device"),
+		To:         time.Now(),
+		Bucket:     defaultBucket,
+		Fields:     []string{"temperature"},
+		Aggregates: []string{AggregateAvg},
+	}
+
+	var err error
+	if to := c.QueryParam("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, fmt.Errorf("invalid to: %s", to)
+		}
+	}
+	q.From = q.To.Add(-defaultQueryPeriod)
+	if from := c.QueryParam("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, fmt.Errorf("invalid from: %s", from)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must be before to")
+	}
+
+	if bucket := c.QueryParam("bucket"); bucket != "" {
+		if q.Bucket, err = time.ParseDuration(bucket); err != nil || q.Bucket < time.Minute {
+			return q, fmt.Errorf("invalid bucket: %s, use a duration of at least 1m", bucket)
+		}
+	}
+	if q.To.Sub(q.From)/q.Bucket > maxBucketsInQuery {
+		return q, fmt.Errorf("too many buckets, use a larger bucket or a shorter period")
+	}
+	// Older rows of the source are deleted already, only a coarser resolution still has them
+	if cutoff, coarser, ok := retentionCutoff(q.source(), time.Now()); ok && q.From.Before(cutoff) {
+		return q, fmt.Errorf("%s is kept since %s only, use a bucket that is a multiple of %gh or a later from",
+			q.source().name, cutoff.Format(time.RFC3339), coarser.Hours())
+	}
+
+	if fields := c.QueryParam("field"); fields != "" {
+		q.Fields = strings.Split(fields, ",")
+		for _, field := range q.Fields {
+			if _, ok := queryFields[field]; !ok {
+				return q, fmt.Errorf("invalid field: %s", field)
+			}
+		}
+	}
+	if aggregates := c.QueryParam("agg"); aggregates != "" {
+		q.Aggregates = strings.Split(aggregates, ",")
+		for _, aggregate := range q.Aggregates {
+			if !slices.Contains(queryAggregates, aggregate) {
+				return q, fmt.Errorf("invalid agg: %s", aggregate)
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// measurementSource is a table that measurements are aggregated from, the raw measurements or a rollup
+type measurementSource struct {
+	table     Table
+	name      string
+	columns   ColumnList
+	deviceID  ColumnInteger
+	createdAt ColumnTimestampz
+	// period of the rollup, zero for raw measurements
+	period time.Duration
+}
+
+var (
+	rawSource = measurementSource{
+		table:     Measurement,
+		name:      "measurement",
+		columns:   Measurement.AllColumns,
+		deviceID:  Measurement.DeviceID,
+		createdAt: Measurement.CreatedAt,
+	}
+	hourlySource = measurementSource{
+		table:     MeasurementHourly,
+		name:      "measurement_hourly",
+		columns:   MeasurementHourly.AllColumns,
+		deviceID:  MeasurementHourly.DeviceID,
+		createdAt: MeasurementHourly.CreatedAt,
+		period:    time.Hour,
+	}
+	dailySource = measurementSource{
+		table:     MeasurementDaily,
+		name:      "measurement_daily",
+		columns:   MeasurementDaily.AllColumns,
+		deviceID:  MeasurementDaily.DeviceID,
+		createdAt: MeasurementDaily.CreatedAt,
+		period:    24 * time.Hour,
+	}
+)
+
+// source picks the coarsest resolution that the bucket is a multiple of. Rollups include the current
+// hour and day, so they are only behind by the rollup interval.
+func (q MeasurementQuery) source() measurementSource {
+	for _, source := range []measurementSource{dailySource, hourlySource} {
+		if q.Bucket%source.period == 0 {
+			return source
+		}
+	}
+	return rawSource
+}
+
+// bucketExpression puts the rows of the source into buckets aligned to the Unix epoch, the same way as the rollups are
+func bucketExpression(source measurementSource, bucket time.Duration) TimestampzExpression {
+	seconds := int64(bucket.Seconds())
+	return RawTimestampz(fmt.Sprintf("to_timestamp(floor(extract(epoch from %s.created_at) / %d) * %d)", source.name, seconds, seconds))
+}
+
+// sampleCountExpression is the number of readings in a bucket
+func sampleCountExpression(source measurementSource) IntegerExpression {
+	if source.period == 0 {
+		return RawInt("COUNT(*)")
+	}
+	return RawInt(fmt.Sprintf("SUM(%s.sample_count)", source.name))
+}
+
+// fieldCount is the number of readings behind the value of the field in a row of the source. Rows from before
+// the counts were kept count every sample.
+func fieldCount(source measurementSource, field string) string {
+	if source.period == 0 {
+		return storedCount(queryFields[field].Name())
+	}
+	return fmt.Sprintf("(CASE WHEN %[1]s.%[2]s_avg IS NULL THEN 0 ELSE COALESCE(%[1]s.%[2]s_count, %[1]s.sample_count) END)", source.name, field)
+}
+
+// fieldCountExpression is the number of readings of the field in a bucket
+func fieldCountExpression(source measurementSource, field string) IntegerExpression {
+	return RawInt(fmt.Sprintf("SUM(%s)", fieldCount(source, field)))
+}
+
+func aggregateExpression(source measurementSource, field string, aggregate string) Expression {
+	if source.period > 0 {
+		return rollupAggregateExpression(source, field, aggregate)
+	}
+
+	column := queryFields[field]
+	value := FloatExp(column)
+	switch aggregate {
+	case AggregateMin:
+		return MINf(value)
+	case AggregateMax:
+		return MAXf(value)
+	case AggregateAvg:
+		// Rows of merged readings are weighted by the number of readings behind their value
+		return RawFloat(fmt.Sprintf("SUM(measurement.%[1]s::double precision * %[2]s) / NULLIF(SUM(%[2]s), 0)", column.Name(), fieldCount(source, field)))
+	default:
+		// Postgres has no last aggregate, take the newest non null value of the bucket
+		name := column.TableName() + "." + column.Name()
+		return RawFloat(fmt.Sprintf("(array_agg(%s ORDER BY measurement.created_at DESC) FILTER (WHERE %s IS NOT NULL))[1]", name, name))
+	}
+}
+
+// rollupAggregateExpression aggregates the rolled up column of the same aggregate further
+func rollupAggregateExpression(source measurementSource, field string, aggregate string) Expression {
+	name := fmt.Sprintf("%s.%s_%s", source.name, field, aggregate)
+	switch aggregate {
+	case AggregateMin:
+		return RawFloat(fmt.Sprintf("MIN(%s)", name))
+	case AggregateMax:
+		return RawFloat(fmt.Sprintf("MAX(%s)", name))
+	case AggregateAvg:
+		// Averages are weighted by the number of readings behind them
+		return RawFloat(fmt.Sprintf("SUM(%[1]s * %[2]s) / NULLIF(SUM(%[2]s), 0)", name, fieldCount(source, field)))
+	default:
+		return RawFloat(fmt.Sprintf("(array_agg(%[1]s ORDER BY %[2]s.created_at DESC) FILTER (WHERE %[1]s IS NOT NULL))[1]", name, source.name))
+	}
+}
+
+func queryMeasurements(q MeasurementQuery) ([]MeasurementRow, error) {
+	source := q.source()
+	bucket := bucketExpression(source, q.Bucket)
+
+	projections := ProjectionList{Device.Mac, Device.Label, bucket}
+	for _, field := range q.Fields {
+		for _, aggregate := range q.Aggregates {
+			projections = append(projections, aggregateExpression(source, field, aggregate))
+		}
+	}
+
+	condition := source.createdAt.GT_EQ(TimestampzT(q.From)).
+		AND(source.createdAt.LT(TimestampzT(q.To)))
+	if q.Device != "" {
+		if mac, err := normalizeMac(q.Device); err == nil {
+			condition = condition.AND(LOWER(Device.Mac).EQ(String(mac)))
+		} else {
+			condition = condition.AND(Device.Label.EQ(String(q.Device)))
+		}
+	}
+
+	stmt := SELECT(projections).
+		FROM(source.table.INNER_JOIN(Device, Device.ID.EQ(source.deviceID))).
+		WHERE(condition).
+		GROUP_BY(Device.Mac, Device.Label, bucket).
+		ORDER_BY(Device.Mac, bucket)
+
+	query, args := stmt.Sql()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []MeasurementRow{}
+	for rows.Next() {
+		row := MeasurementRow{}
+		values := make([]sql.NullFloat64, len(projections)-3)
+		dest := []any{&row.MAC, &row.Label, &row.Time}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if value.Valid {
+				row.Values = append(row.Values, &value.Float64)
+			} else {
+				row.Values = append(row.Values, nil)
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// getMeasurements returns aggregated measurements as JSON, or as CSV with format=csv or Accept: text/csv
+func getMeasurements(c echo.Context) error {
+	q, err := parseMeasurementQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(400, err.Error())
+	}
+
+	rows, err := queryMeasurements(q)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to query measurements")
+		return echo.NewHTTPError(500, "Failed to read data")
+	}
+
+	columns := q.Columns()
+	if c.QueryParam("format") == "csv" || strings.Contains(c.Request().Header.Get(echo.HeaderAccept), "text/csv") {
+		return writeMeasurementsCsv(c, columns, rows)
+	}
+
+	result := []map[string]any{}
+	for _, row := range rows {
+		item := map[string]any{
+			"mac":   row.MAC,
+			"label": row.Label,
+			"time":  row.Time,
+		}
+		for i, column := range columns {
+			item[column] = row.Values[i]
+		}
+		result = append(result, item)
+	}
+	return c.JSON(200, result)
+}
+
+func writeMeasurementsCsv(c echo.Context, columns []string, rows []MeasurementRow) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().WriteHeader(200)
+
+	w := csv.NewWriter(c.Response())
+	if err := w.Write(append([]string{"mac", "label", "time"}, columns...)); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := []string{row.MAC, row.Label, row.Time.Format(time.RFC3339)}
+		for _, value := range row.Values {
+			if value == nil {
+				record = append(record, "")
+			} else {
+				record = append(record, strconv.FormatFloat(*value, 'f', -1, 64))
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
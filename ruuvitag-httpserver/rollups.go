@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/go-jet/jet/v2/postgres"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Downsampling and retention. Raw measurements are rolled up into hourly aggregates and those into
+// daily aggregates. Raw and hourly rows older than their retention are deleted, and so are the Ruuvi
+// Station event IDs that are too old to be forwarded again.
+
+const (
+	// rollupLookback is how far back each run rolls up again, to pick up readings that arrived late
+	rollupLookback = 48 * time.Hour
+
+	defaultRollupInterval   = 5 * time.Minute
+	defaultStationEventDays = 7
+	// minRetentionDays keeps rows at least until they have been rolled up
+	minRetentionDays = 3
+)
+
+type RetentionConfig struct {
+	// Interval between rollup runs
+	Interval time.Duration `yaml:"interval"`
+	// RawDays keeps raw measurements this many days, 0 keeps them forever
+	RawDays int `yaml:"rawDays"`
+	// HourlyDays keeps hourly rollups this many days, 0 keeps them forever
+	HourlyDays int `yaml:"hourlyDays"`
+	// StationEventDays keeps the IDs of Ruuvi Station events this many days to skip forwarded duplicates
+	StationEventDays int `yaml:"stationEventDays"`
+}
+
+// rollupFields are the fields of the query API that have rollup columns
+var rollupFields = []string{"temperature", "humidity", "pressure", "battery", "rssi"}
+
+var (
+	rollupLock sync.Mutex
+	// rollupSince is the oldest time that has to be rolled up again on the next run, e.g. after a backfill
+	rollupSince *time.Time
+)
+
+func defaultRetentionConfig() RetentionConfig {
+	return RetentionConfig{Interval: defaultRollupInterval, StationEventDays: defaultStationEventDays}
+}
+
+func checkRetentionConfig(c RetentionConfig) error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("retention interval must be positive")
+	}
+	if c.RawDays != 0 && c.RawDays < minRetentionDays {
+		return fmt.Errorf("retention rawDays must be 0 or at least %d", minRetentionDays)
+	}
+	if c.HourlyDays != 0 && c.HourlyDays < minRetentionDays {
+		return fmt.Errorf("retention hourlyDays must be 0 or at least %d", minRetentionDays)
+	}
+	if c.StationEventDays < 1 {
+		return fmt.Errorf("retention stationEventDays must be at least 1")
+	}
+	return nil
+}
+
+// requestRollup makes the next run roll up everything since the given time
+func requestRollup(since time.Time) {
+	rollupLock.Lock()
+	defer rollupLock.Unlock()
+
+	if rollupSince == nil || since.Before(*rollupSince) {
+		rollupSince = &since
+	}
+}
+
+// runRollups rolls up and deletes expired rows every retention interval
+func runRollups() {
+	ticker := time.NewTicker(config.Retention.Interval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		rollupLock.Lock()
+		requested := rollupSince
+		rollupSince = nil
+		rollupLock.Unlock()
+
+		err := rollupInto(hourlySource, rawSource, requested)
+		if err == nil {
+			err = rollupInto(dailySource, hourlySource, requested)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to roll up measurements")
+			// Try again on the next run, expired rows are not deleted before they are rolled up
+			if requested != nil {
+				requestRollup(*requested)
+			}
+			continue
+		}
+		deleteExpired(rawSource)
+		deleteExpired(hourlySource)
+		deleteStationEvents(time.Now().AddDate(0, 0, -config.Retention.StationEventDays))
+	}
+}
+
+// rollupStart returns where to start rolling up: the lookback before the newest rollup, or the requested
+// time when that is older. An empty rollup table is filled from the beginning. It never goes back before
+// the retention cutoff of the source, the buckets before it were rolled up from rows that are deleted by now
+// and would be rewritten from a late reading alone.
+func rollupStart(target measurementSource, source measurementSource, requested *time.Time) (time.Time, error) {
+	var latest struct {
+		Latest *time.Time
+	}
+	stmt := SELECT(MAX(target.createdAt).AS("latest")).FROM(target.table)
+	if err := stmt.Query(db, &latest); err != nil {
+		return time.Time{}, err
+	}
+
+	var since time.Time
+	if latest.Latest != nil {
+		since = latest.Latest.Add(-rollupLookback)
+		if requested != nil && requested.Before(since) {
+			since = *requested
+		}
+	}
+	return clampRollupStart(since.Truncate(target.period), source, time.Now()), nil
+}
+
+// clampRollupStart moves the start of a rollup forward to the retention cutoff of its source
+func clampRollupStart(since time.Time, source measurementSource, now time.Time) time.Time {
+	if cutoff, _, ok := retentionCutoff(source, now); ok && since.Before(cutoff) {
+		return cutoff
+	}
+	return since
+}
+
+// rollupInto aggregates the source into the buckets of the target. Buckets are rewritten as a whole,
+// including the current one that is still filling up.
+func rollupInto(target measurementSource, source measurementSource, requested *time.Time) error {
+	since, err := rollupStart(target, source, requested)
+	if err != nil {
+		return err
+	}
+
+	bucket := bucketExpression(source, target.period)
+	projections := rollupProjections(source, bucket)
+
+	// Columns are in the same order as the projections
+	assignments := []ColumnAssigment{}
+	for _, column := range target.columns {
+		switch c := column.(type) {
+		case ColumnFloat:
+			assignments = append(assignments, c.SET(RawFloat("excluded."+c.Name())))
+		case ColumnInteger:
+			if c.Name() != target.deviceID.Name() {
+				assignments = append(assignments, c.SET(RawInt("excluded."+c.Name())))
+			}
+		}
+	}
+
+	insertStmt := target.table.INSERT(target.columns).
+		QUERY(
+			SELECT(projections).
+				FROM(source.table).
+				WHERE(source.createdAt.GT_EQ(TimestampzT(since))).
+				GROUP_BY(source.deviceID, bucket),
+		).
+		ON_CONFLICT(target.deviceID, target.createdAt).
+		DO_UPDATE(SET(assignments...))
+
+	started := time.Now()
+	result, err := insertStmt.Exec(db)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	log.Debug().Msgf("Rolled up %d rows of %s since %s in %s", rows, target.name, since.Format(time.RFC3339), time.Since(started))
+	return nil
+}
+
+// rollupProjections are the columns of a rollup row aggregated from the source, in the order of the rollup table
+func rollupProjections(source measurementSource, bucket TimestampzExpression) ProjectionList {
+	projections := ProjectionList{source.deviceID, bucket, sampleCountExpression(source)}
+	for _, field := range rollupFields {
+		for _, aggregate := range queryAggregates {
+			projections = append(projections, aggregateExpression(source, field, aggregate))
+		}
+	}
+	for _, field := range rollupFields {
+		projections = append(projections, fieldCountExpression(source, field))
+	}
+	return projections
+}
+
+// retentionCutoff returns the time before which rows of the source are deleted, aligned to the buckets of
+// the next coarser resolution so that only whole buckets go, and that resolution. ok is false for sources
+// that are kept forever.
+func retentionCutoff(source measurementSource, now time.Time) (cutoff time.Time, coarser time.Duration, ok bool) {
+	var days int
+	switch source.period {
+	case 0:
+		days, coarser = config.Retention.RawDays, hourlySource.period
+	case hourlySource.period:
+		days, coarser = config.Retention.HourlyDays, dailySource.period
+	default:
+		return cutoff, 0, false
+	}
+	if days <= 0 {
+		return cutoff, 0, false
+	}
+	return now.AddDate(0, 0, -days).Truncate(coarser), coarser, true
+}
+
+// deleteExpired deletes the rows of the source that are older than its retention
+func deleteExpired(source measurementSource) {
+	cutoff, _, ok := retentionCutoff(source, time.Now())
+	if !ok {
+		return
+	}
+
+	deleteStmt := source.table.DELETE().WHERE(source.createdAt.LT(TimestampzT(cutoff)))
+	result, err := deleteStmt.Exec(db)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to delete expired rows of %s", source.name)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Info().Msgf("Deleted %d rows of %s before %s", rows, source.name, cutoff.Format(time.RFC3339))
+	}
+}
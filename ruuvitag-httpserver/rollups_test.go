@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/go-jet/jet/v2/postgres"
+)
+
+func TestClampRollupStart(t *testing.T) {
+	previousConfig := config
+	t.Cleanup(func() { config = previousConfig })
+	config = defaultConfig()
+	config.Retention.RawDays = 7
+	config.Retention.HourlyDays = 30
+
+	now := time.Date(2024, 3, 10, 14, 37, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		since  time.Time
+		source measurementSource
+		want   time.Time
+	}{
+		{name: "after the raw cutoff", since: time.Date(2024, 3, 8, 14, 0, 0, 0, time.UTC), source: rawSource,
+			want: time.Date(2024, 3, 8, 14, 0, 0, 0, time.UTC)},
+		{name: "before the raw cutoff", since: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), source: rawSource,
+			want: time.Date(2024, 3, 3, 14, 0, 0, 0, time.UTC)},
+		{name: "from the beginning", since: time.Time{}, source: rawSource,
+			want: time.Date(2024, 3, 3, 14, 0, 0, 0, time.UTC)},
+		{name: "before the hourly cutoff", since: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), source: hourlySource,
+			want: time.Date(2024, 2, 9, 0, 0, 0, 0, time.UTC)},
+		{name: "daily is kept forever", since: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), source: dailySource,
+			want: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampRollupStart(tt.since, tt.source, now); !got.Equal(tt.want) {
+				t.Errorf("clampRollupStart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	config.Retention.RawDays = 0
+	since := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := clampRollupStart(since, rawSource, now); !got.Equal(since) {
+		t.Errorf("clampRollupStart() without raw retention = %s, want %s", got, since)
+	}
+}
+
+func TestRollupProjections(t *testing.T) {
+	for _, tt := range []struct {
+		target measurementSource
+		source measurementSource
+	}{
+		{target: hourlySource, source: rawSource},
+		{target: dailySource, source: hourlySource},
+	} {
+		t.Run(tt.target.name, func(t *testing.T) {
+			projections := rollupProjections(tt.source, bucketExpression(tt.source, tt.target.period))
+			if len(projections) != len(tt.target.columns) {
+				t.Fatalf("rollupProjections() has %d projections, want one for each of the %d columns of %s",
+					len(projections), len(tt.target.columns), tt.target.name)
+			}
+
+			query, _ := SELECT(projections).FROM(tt.source.table).Sql()
+			// Averages are weighted by the readings of the field, not by the samples of the row
+			count := tt.source.name + ".temperature_count"
+			if !strings.Contains(query, count) {
+				t.Errorf("rollupProjections() query does not use %s:\n%s", count, query)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Decoding of Ruuvitag manufacturer specific data.
+// See https://github.com/ruuvi/ruuvi-sensor-protocols for the data formats.
+
+const (
+	dataFormat3 = 0x03
+	dataFormat5 = 0x05
+
+	dataFormat3Length  = 14
+	dataFormat5Length  = 24
+	customFormatLength = 16
+
+	// AD type of manufacturer specific data in a BLE advertisement
+	adTypeManufacturerData = 0xFF
+)
+
+var (
+	// Ruuvi Innovations Ltd. company identifier 0x0499, little endian as in the advertisement
+	ruuviManufacturerPrefix = []byte{0x99, 0x04}
+	// Our own minimal layout: manufacturer 0x1CA3, version 0x01
+	customFormatPrefix = []byte{0x1C, 0xA3, 0x01}
+)
+
+// decodeManufacturerData detects the format of the given manufacturer data and decodes it.
+// Data may be given with or without the Ruuvi company identifier in front of it.
+// Fields that the tag reports as not available are left nil.
+func decodeManufacturerData(data []byte) (*MeasurementJson, error) {
+	if bytes.HasPrefix(data, customFormatPrefix) {
+		return decodeCustomFormat(data)
+	}
+
+	data = bytes.TrimPrefix(data, ruuviManufacturerPrefix)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty data")
+	}
+
+	switch data[0] {
+	case dataFormat5:
+		return decodeDataFormat5(data)
+	case dataFormat3:
+		return decodeDataFormat3(data)
+	default:
+		return nil, fmt.Errorf("unsupported data format 0x%02x", data[0])
+	}
+}
+
+// decodeAdvertisement decodes a raw BLE advertisement as relayed by the Ruuvi Gateway, e.g.
+// 0201061BFF9904..., by finding its manufacturer specific data
+func decodeAdvertisement(advertisement []byte) (*MeasurementJson, error) {
+	for i := 0; i < len(advertisement); {
+		length := int(advertisement[i])
+		if length == 0 {
+			break
+		}
+		if i+1+length > len(advertisement) {
+			return nil, fmt.Errorf("truncated advertisement structure at byte %d", i)
+		}
+		if advertisement[i+1] == adTypeManufacturerData {
+			return decodeManufacturerData(advertisement[i+2 : i+1+length])
+		}
+		i += 1 + length
+	}
+	return nil, fmt.Errorf("no manufacturer data in advertisement")
+}
+
+// decodeDataFormat5 decodes data format 5 (RAWv2)
+// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/dataformat_05.md
+func decodeDataFormat5(data []byte) (*MeasurementJson, error) {
+	if len(data) < dataFormat5Length {
+		return nil, fmt.Errorf("data format 5 needs %d bytes, got %d", dataFormat5Length, len(data))
+	}
+
+	m := new(MeasurementJson)
+
+	if raw := int16(binary.BigEndian.Uint16(data[1:3])); raw != -32768 {
+		temperature := 0.005 * float64(raw)
+		m.Temperature = &temperature
+	}
+	if raw := binary.BigEndian.Uint16(data[3:5]); raw != 0xFFFF {
+		humidity := 0.0025 * float64(raw)
+		m.Humidity = &humidity
+	}
+	if raw := binary.BigEndian.Uint16(data[5:7]); raw != 0xFFFF {
+		pressure := int32(raw) + 50000
+		m.Pressure = &pressure
+	}
+	m.AccelerationX = decodeAcceleration(data[7:9])
+	m.AccelerationY = decodeAcceleration(data[9:11])
+	m.AccelerationZ = decodeAcceleration(data[11:13])
+
+	powerInfo := binary.BigEndian.Uint16(data[13:15])
+	if raw := powerInfo >> 5; raw != 0x07FF {
+		battery := int32(raw) + 1600
+		m.Battery = &battery
+	}
+	if raw := powerInfo & 0x1F; raw != 0x1F {
+		txPower := int32(raw)*2 - 40
+		m.TxPower = &txPower
+	}
+	if raw := data[15]; raw != 0xFF {
+		movementCounter := int64(raw)
+		m.MovementCounter = &movementCounter
+	}
+	if raw := binary.BigEndian.Uint16(data[16:18]); raw != 0xFFFF {
+		sequenceNumber := int64(raw)
+		m.MeasurementSequenceNumber = &sequenceNumber
+	}
+	if rawMac := data[18:24]; !bytes.Equal(rawMac, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		m.MAC = formatMac(rawMac)
+	}
+
+	return m, nil
+}
+
+// decodeDataFormat3 decodes data format 3 (RAWv1). This format does not contain the MAC address.
+// https://github.com/ruuvi/ruuvi-sensor-protocols/blob/master/dataformat_03.md
+func decodeDataFormat3(data []byte) (*MeasurementJson, error) {
+	if len(data) < dataFormat3Length {
+		return nil, fmt.Errorf("data format 3 needs %d bytes, got %d", dataFormat3Length, len(data))
+	}
+
+	m := new(MeasurementJson)
+
+	humidity := 0.5 * float64(data[1])
+	m.Humidity = &humidity
+
+	// Integer part is sign and magnitude, fraction is in hundredths of a degree
+	temperature := float64(data[2]&0x7F) + float64(data[3])/100
+	if data[2]&0x80 != 0 {
+		temperature = -temperature
+	}
+	m.Temperature = &temperature
+
+	pressure := int32(binary.BigEndian.Uint16(data[4:6])) + 50000
+	m.Pressure = &pressure
+
+	accelerationX := int32(int16(binary.BigEndian.Uint16(data[6:8])))
+	accelerationY := int32(int16(binary.BigEndian.Uint16(data[8:10])))
+	accelerationZ := int32(int16(binary.BigEndian.Uint16(data[10:12])))
+	m.AccelerationX = &accelerationX
+	m.AccelerationY = &accelerationY
+	m.AccelerationZ = &accelerationZ
+
+	battery := int32(binary.BigEndian.Uint16(data[12:14]))
+	m.Battery = &battery
+
+	return m, nil
+}
+
+// decodeCustomFormat decodes our own layout used before the standard formats were supported.
+// It carries temperature, humidity, battery and MAC address in the same units as data format 5.
+func decodeCustomFormat(data []byte) (*MeasurementJson, error) {
+	if len(data) < customFormatLength {
+		return nil, fmt.Errorf("custom format needs %d bytes, got %d", customFormatLength, len(data))
+	}
+
+	rawTemperature := int16(data[3])<<8 | int16(data[4])
+	temperature := 0.005 * float64(rawTemperature)
+
+	rawHumidity := uint16(data[5])<<8 | uint16(data[6])
+	humidity := 0.0025 * float64(rawHumidity)
+
+	rawBattery := uint16(data[7])<<3 | uint16(data[8])>>5
+	battery := int32(rawBattery) + 1600
+
+	m := new(MeasurementJson)
+	m.Temperature = &temperature
+	m.Humidity = &humidity
+	m.Battery = &battery
+	m.MAC = formatMac(data[9:15])
+
+	return m, nil
+}
+
+func decodeAcceleration(data []byte) *int32 {
+	raw := int16(binary.BigEndian.Uint16(data))
+	if raw == -32768 {
+		return nil
+	}
+	acceleration := int32(raw)
+	return &acceleration
+}
+
+func formatMac(rawMac []byte) string {
+	var hexParts []string
+	for _, b := range rawMac {
+		hexParts = append(hexParts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(hexParts, ":")
+}
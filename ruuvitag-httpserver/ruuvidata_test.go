@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+// Test vectors of https://github.com/ruuvi/ruuvi-sensor-protocols
+
+func float(value float64) *float64 { return &value }
+func int32p(value int32) *int32    { return &value }
+func int64p(value int64) *int64    { return &value }
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid test data %s: %v", s, err)
+	}
+	return data
+}
+
+func checkFloat(t *testing.T, field string, got *float64, want *float64) {
+	t.Helper()
+	switch {
+	case got == nil && want == nil:
+	case got == nil || want == nil:
+		t.Errorf("%s = %v, want %v", field, got, want)
+	case math.Abs(*got-*want) > 1e-9:
+		t.Errorf("%s = %g, want %g", field, *got, *want)
+	}
+}
+
+func checkInt[T int32 | int64](t *testing.T, field string, got *T, want *T) {
+	t.Helper()
+	switch {
+	case got == nil && want == nil:
+	case got == nil || want == nil:
+		t.Errorf("%s = %v, want %v", field, got, want)
+	case *got != *want:
+		t.Errorf("%s = %d, want %d", field, *got, *want)
+	}
+}
+
+func checkMeasurement(t *testing.T, got *MeasurementJson, want MeasurementJson) {
+	t.Helper()
+	if got.MAC != want.MAC {
+		t.Errorf("MAC = %q, want %q", got.MAC, want.MAC)
+	}
+	checkFloat(t, "temperature", got.Temperature, want.Temperature)
+	checkFloat(t, "humidity", got.Humidity, want.Humidity)
+	checkInt(t, "pressure", got.Pressure, want.Pressure)
+	checkInt(t, "accelerationX", got.AccelerationX, want.AccelerationX)
+	checkInt(t, "accelerationY", got.AccelerationY, want.AccelerationY)
+	checkInt(t, "accelerationZ", got.AccelerationZ, want.AccelerationZ)
+	checkInt(t, "battery", got.Battery, want.Battery)
+	checkInt(t, "txPower", got.TxPower, want.TxPower)
+	checkInt(t, "movementCounter", got.MovementCounter, want.MovementCounter)
+	checkInt(t, "measurementSequenceNumber", got.MeasurementSequenceNumber, want.MeasurementSequenceNumber)
+}
+
+func TestDecodeDataFormat5(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want MeasurementJson
+	}{
+		{
+			name: "valid",
+			data: "0512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F",
+			want: MeasurementJson{
+				MAC:                       "cb:b8:33:4c:88:4f",
+				Temperature:               float(24.3),
+				Humidity:                  float(53.49),
+				Pressure:                  int32p(100044),
+				AccelerationX:             int32p(4),
+				AccelerationY:             int32p(-4),
+				AccelerationZ:             int32p(1036),
+				Battery:                   int32p(2977),
+				TxPower:                   int32p(4),
+				MovementCounter:           int64p(66),
+				MeasurementSequenceNumber: int64p(205),
+			},
+		},
+		{
+			name: "maximum",
+			data: "057FFFFFFEFFFE7FFF7FFF7FFFFFDEFEFFFECBB8334C884F",
+			want: MeasurementJson{
+				MAC:                       "cb:b8:33:4c:88:4f",
+				Temperature:               float(163.835),
+				Humidity:                  float(163.835),
+				Pressure:                  int32p(115534),
+				AccelerationX:             int32p(32767),
+				AccelerationY:             int32p(32767),
+				AccelerationZ:             int32p(32767),
+				Battery:                   int32p(3646),
+				TxPower:                   int32p(20),
+				MovementCounter:           int64p(254),
+				MeasurementSequenceNumber: int64p(65534),
+			},
+		},
+		{
+			name: "minimum",
+			data: "058001000000008001800180010000000000CBB8334C884F",
+			want: MeasurementJson{
+				MAC:                       "cb:b8:33:4c:88:4f",
+				Temperature:               float(-163.835),
+				Humidity:                  float(0),
+				Pressure:                  int32p(50000),
+				AccelerationX:             int32p(-32767),
+				AccelerationY:             int32p(-32767),
+				AccelerationZ:             int32p(-32767),
+				Battery:                   int32p(1600),
+				TxPower:                   int32p(-40),
+				MovementCounter:           int64p(0),
+				MeasurementSequenceNumber: int64p(0),
+			},
+		},
+		{
+			name: "not available",
+			data: "058000FFFFFFFF800080008000FFFFFFFFFFFFFFFFFFFFFF",
+			want: MeasurementJson{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := decodeDataFormat5(decodeHex(t, tt.data))
+			if err != nil {
+				t.Fatalf("decodeDataFormat5() error = %v", err)
+			}
+			checkMeasurement(t, m, tt.want)
+		})
+	}
+}
+
+func TestDecodeDataFormat3(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want MeasurementJson
+	}{
+		{
+			name: "valid",
+			data: "03291A1ECE1EFC18F94202CA0B53",
+			want: MeasurementJson{
+				Temperature:   float(26.3),
+				Humidity:      float(20.5),
+				Pressure:      int32p(102766),
+				AccelerationX: int32p(-1000),
+				AccelerationY: int32p(-1726),
+				AccelerationZ: int32p(714),
+				Battery:       int32p(2899),
+			},
+		},
+		{
+			name: "maximum",
+			data: "03FF7F63FFFF7FFF7FFF7FFFFFFF",
+			want: MeasurementJson{
+				Temperature:   float(127.99),
+				Humidity:      float(127.5),
+				Pressure:      int32p(115535),
+				AccelerationX: int32p(32767),
+				AccelerationY: int32p(32767),
+				AccelerationZ: int32p(32767),
+				Battery:       int32p(65535),
+			},
+		},
+		{
+			name: "minimum",
+			data: "0300FF6300008001800180010000",
+			want: MeasurementJson{
+				Temperature:   float(-127.99),
+				Humidity:      float(0),
+				Pressure:      int32p(50000),
+				AccelerationX: int32p(-32767),
+				AccelerationY: int32p(-32767),
+				AccelerationZ: int32p(-32767),
+				Battery:       int32p(0),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := decodeDataFormat3(decodeHex(t, tt.data))
+			if err != nil {
+				t.Fatalf("decodeDataFormat3() error = %v", err)
+			}
+			checkMeasurement(t, m, tt.want)
+		})
+	}
+}
+
+func TestDecodeManufacturerData(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: "format 5 with company identifier", data: "99040512FC5394C37C0004FFFC040CAC364200CDCBB8334C884F"},
+		{name: "format 3 with company identifier", data: "990403291A1ECE1EFC18F94202CA0B53"},
+		{name: "format 5 too short", data: "0512FC5394C37C0004FFFC040CAC364200CD", wantErr: true},
+		{name: "format 3 too short", data: "03291A1ECE1EFC18F942", wantErr: true},
+		{name: "unsupported format", data: "9904080102", wantErr: true},
+		{name: "empty", data: "9904", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeManufacturerData(decodeHex(t, tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeManufacturerData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
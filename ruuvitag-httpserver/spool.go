@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Write-ahead spool for when Postgres or MQTT is unavailable. Accepted measurements that cannot be
+// written are appended to an append-only file and synced to disk before they are acknowledged. The
+// spool is drained in order once both are back; until it is empty new measurements are spooled too, so
+// that they are not stored before older ones.
+//
+// The file holds one JSON entry per line. The offset of the first entry that has not been drained is kept
+// in a separate file, and both are truncated once everything has been drained.
+
+const (
+	spoolFileName       = "measurements.spool"
+	spoolOffsetFileName = "measurements.offset"
+
+	defaultSpoolDir      = "spool"
+	spoolDrainInterval   = 5 * time.Second
+	defaultSpoolMaxBytes = 256 << 20
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+type SpoolConfig struct {
+	// Dir holds the spool files, relative to the working directory
+	Dir string `yaml:"dir"`
+	// MaxBytes limits the size of the spool file, measurements are refused once it is reached
+	MaxBytes int64 `yaml:"maxBytes"`
+}
+
+type spoolEntry struct {
+	SpooledAt   time.Time        `json:"spooledAt"`
+	Measurement *MeasurementJson `json:"measurement"`
+}
+
+// spoolMark is where a pending entry ends in the file and when it was spooled
+type spoolMark struct {
+	end       int64
+	spooledAt time.Time
+}
+
+type Spool struct {
+	lock       sync.Mutex
+	file       *os.File
+	offsetPath string
+	maxBytes   int64
+	// offset is where the first pending entry starts, size where the file ends
+	offset  int64
+	size    int64
+	pending []spoolMark
+	wake    chan struct{}
+}
+
+// SpoolStatus is the spool part of GET /status
+type SpoolStatus struct {
+	Depth  int        `json:"depth"`
+	Bytes  int64      `json:"bytes"`
+	Oldest *time.Time `json:"oldest,omitempty"`
+	// AgeSeconds is the age of the oldest pending entry
+	AgeSeconds float64 `json:"ageSeconds"`
+}
+
+type StatusJson struct {
+	Postgres bool        `json:"postgres"`
+	Mqtt     bool        `json:"mqtt"`
+	Spool    SpoolStatus `json:"spool"`
+}
+
+var spool *Spool
+
+func defaultSpoolConfig() SpoolConfig {
+	return SpoolConfig{Dir: defaultSpoolDir, MaxBytes: defaultSpoolMaxBytes}
+}
+
+func checkSpoolConfig(c SpoolConfig) error {
+	if c.Dir == "" {
+		return fmt.Errorf("spool dir is missing")
+	}
+	if c.MaxBytes <= 0 {
+		return fmt.Errorf("spool maxBytes must be positive")
+	}
+	return nil
+}
+
+// openSpool opens the spool in the directory and finds the entries that were not drained before a restart
+func openSpool(c SpoolConfig) (*Spool, error) {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(c.Dir, spoolFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		file:       file,
+		offsetPath: filepath.Join(c.Dir, spoolOffsetFileName),
+		maxBytes:   c.MaxBytes,
+		wake:       make(chan struct{}, 1),
+	}
+
+	if data, err := os.ReadFile(s.offsetPath); err == nil {
+		s.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid spool offset: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if s.offset > info.Size() {
+		// The spool was emptied before the offset was reset
+		s.offset = 0
+	}
+	if err := s.scan(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(s.pending) > 0 {
+		log.Warn().Msgf("Spool has %d measurements from before the restart", len(s.pending))
+	}
+	return s, nil
+}
+
+// scan reads the pending entries from the offset on. A last line that was cut short by a crash was never
+// acknowledged and is truncated.
+func (s *Spool) scan() error {
+	if _, err := s.file.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(s.file)
+	position := s.offset
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Warn().Msgf("Truncating %d bytes of an incomplete spool entry", len(line))
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("invalid spool entry at %d: %w", position, err)
+		}
+		position += int64(len(line))
+		s.pending = append(s.pending, spoolMark{end: position, spooledAt: entry.SpooledAt})
+	}
+	s.size = position
+	return s.file.Truncate(s.size)
+}
+
+// depth returns the number of pending entries
+func (s *Spool) depth() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pending)
+}
+
+func (s *Spool) status() SpoolStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := SpoolStatus{Depth: len(s.pending), Bytes: s.size - s.offset}
+	if len(s.pending) > 0 {
+		oldest := s.pending[0].spooledAt
+		status.Oldest = &oldest
+		status.AgeSeconds = time.Since(oldest).Seconds()
+	}
+	return status
+}
+
+// append writes the measurement to the spool and returns once it is on disk
+func (s *Spool) append(m *MeasurementJson) error {
+	// The reading is stored later, it must not take the time of storing as its time
+	if m.Timestamp == nil {
+		now := time.Now()
+		m.Timestamp = &now
+	}
+	entry := spoolEntry{SpooledAt: time.Now(), Measurement: m}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.size+int64(len(data)) > s.maxBytes {
+		return errSpoolFull
+	}
+	if _, err := s.file.WriteAt(data, s.size); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(data))
+	s.pending = append(s.pending, spoolMark{end: s.size, spooledAt: entry.SpooledAt})
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the first pending measurement, nil when the spool is empty
+func (s *Spool) peek() (*MeasurementJson, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil, nil
+	}
+	data := make([]byte, s.pending[0].end-s.offset)
+	if _, err := s.file.ReadAt(data, s.offset); err != nil {
+		return nil, err
+	}
+	var entry spoolEntry
+	if err := json.Unmarshal(bytes.TrimSpace(data), &entry); err != nil {
+		return nil, err
+	}
+	return entry.Measurement, nil
+}
+
+// pop removes the first pending entry after it has been drained. The files are emptied once nothing is pending.
+func (s *Spool) pop() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.offset = s.pending[0].end
+	s.pending = s.pending[1:]
+	if err := s.writeOffset(); err != nil {
+		return err
+	}
+	if len(s.pending) > 0 {
+		return nil
+	}
+	// An offset past the end of the file after a crash in between is taken as an empty spool
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.offset, s.size = 0, 0
+	return s.writeOffset()
+}
+
+// writeOffset replaces the offset file and syncs it, so that a crash neither replays nor skips entries
+func (s *Spool) writeOffset() error {
+	temporary := s.offsetPath + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(strconv.FormatInt(s.offset, 10)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, s.offsetPath); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(s.offsetPath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// storageAvailable is whether measurements can be written and published right now
+func storageAvailable() bool {
+	return mqttClient.IsConnectionOpen() && db.Ping() == nil
+}
+
+// spoolMeasurement spools the measurement instead of storing it
+func spoolMeasurement(m *MeasurementJson, cause error) error {
+	if err := spool.append(m); err != nil {
+		log.Error().Err(err).Msgf("Failed to spool measurement of %s", m.MAC)
+		return err
+	}
+	if cause != nil {
+		log.Warn().Err(cause).Msgf("Spooled measurement of %s", m.MAC)
+	} else {
+		log.Debug().Msgf("Spooled measurement of %s behind %d others", m.MAC, spool.depth()-1)
+	}
+	return nil
+}
+
+// keepUnwritable keeps a spooled measurement that was acknowledged but cannot be written in
+// rejected_measurement, whether or not rejected measurements are stored otherwise
+func keepUnwritable(m *MeasurementJson, err error) {
+	countRejected(RejectReasonUnwritable)
+	log.Error().Err(err).Msgf("Spooled measurement of %s cannot be written, keeping it in rejected_measurement", m.MAC)
+	storeRejectedMeasurement(m, []Violation{{Rule: RejectReasonUnwritable, Message: err.Error()}})
+}
+
+// drainSpool writes the spooled measurements in order whenever Postgres and MQTT are available
+func drainSpool() {
+	ticker := time.NewTicker(spoolDrainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-spool.wake:
+		}
+		if spool.depth() == 0 || !storageAvailable() {
+			continue
+		}
+
+		drained := 0
+		for {
+			m, err := spool.peek()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to read spool")
+				break
+			}
+			if m == nil {
+				break
+			}
+			if err := writeAccepted(m); err != nil {
+				if isTransientError(err) || !storageAvailable() {
+					log.Warn().Err(err).Msgf("Storage unavailable again, %d measurements left in spool", spool.depth())
+					break
+				}
+				// It would block the spool forever, e.g. because the device was retired in the meantime
+				keepUnwritable(m, err)
+			}
+			if err := spool.pop(); err != nil {
+				log.Error().Err(err).Msg("Failed to update spool offset")
+				break
+			}
+			drained++
+		}
+		if drained > 0 {
+			log.Info().Msgf("Drained %d measurements from spool, %d left", drained, spool.depth())
+		}
+	}
+}
+
+func getStatus(c echo.Context) error {
+	status := StatusJson{
+		Postgres: db.Ping() == nil,
+		Mqtt:     mqttClient.IsConnectionOpen(),
+		Spool:    spool.status(),
+	}
+	code := 200
+	if !status.Postgres || !status.Mqtt {
+		code = 503
+	}
+	return c.JSON(code, status)
+}
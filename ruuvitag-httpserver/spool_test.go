@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestSpool(t *testing.T, c SpoolConfig) *Spool {
+	t.Helper()
+	s, err := openSpool(c)
+	if err != nil {
+		t.Fatalf("openSpool() error = %v", err)
+	}
+	t.Cleanup(func() { s.file.Close() })
+	return s
+}
+
+func appendTestMeasurements(t *testing.T, s *Spool, macs ...string) {
+	t.Helper()
+	for _, mac := range macs {
+		if err := s.append(&MeasurementJson{MAC: mac}); err != nil {
+			t.Fatalf("append() error = %v", err)
+		}
+	}
+}
+
+// drainTestSpool pops every pending entry and returns their MACs in order
+func drainTestSpool(t *testing.T, s *Spool) []string {
+	t.Helper()
+	macs := []string{}
+	for {
+		m, err := s.peek()
+		if err != nil {
+			t.Fatalf("peek() error = %v", err)
+		}
+		if m == nil {
+			return macs
+		}
+		if m.Timestamp == nil {
+			t.Errorf("spooled measurement of %s has no timestamp", m.MAC)
+		}
+		macs = append(macs, m.MAC)
+		if err := s.pop(); err != nil {
+			t.Fatalf("pop() error = %v", err)
+		}
+	}
+}
+
+func checkMacs(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("drained %v, want %v", got, want)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	return info.Size()
+}
+
+func TestSpoolRestart(t *testing.T) {
+	c := SpoolConfig{Dir: t.TempDir(), MaxBytes: defaultSpoolMaxBytes}
+	s := openTestSpool(t, c)
+	appendTestMeasurements(t, s, "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03")
+	if err := s.pop(); err != nil {
+		t.Fatalf("pop() error = %v", err)
+	}
+	s.file.Close()
+
+	s = openTestSpool(t, c)
+	if got := s.depth(); got != 2 {
+		t.Fatalf("depth() after restart = %d, want 2", got)
+	}
+	checkMacs(t, drainTestSpool(t, s), "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03")
+
+	if size := fileSize(t, filepath.Join(c.Dir, spoolFileName)); size != 0 {
+		t.Errorf("spool file is %d bytes after draining, want 0", size)
+	}
+	if data, err := os.ReadFile(filepath.Join(c.Dir, spoolOffsetFileName)); err != nil || string(data) != "0" {
+		t.Errorf("offset file after draining = %q, %v, want 0", data, err)
+	}
+	if status := s.status(); status.Depth != 0 || status.Bytes != 0 || status.Oldest != nil {
+		t.Errorf("status() after draining = %+v, want an empty spool", status)
+	}
+}
+
+func TestSpoolTruncatesIncompleteEntry(t *testing.T) {
+	c := SpoolConfig{Dir: t.TempDir(), MaxBytes: defaultSpoolMaxBytes}
+	s := openTestSpool(t, c)
+	appendTestMeasurements(t, s, "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02")
+	complete := s.size
+	s.file.Close()
+
+	// A crash in the middle of writing the next entry
+	path := filepath.Join(c.Dir, spoolFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"spooledAt":"2024-01-01T00:00:00Z","measurement":{"mac":"aa:`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	s = openTestSpool(t, c)
+	if size := fileSize(t, path); size != complete {
+		t.Errorf("spool file is %d bytes after the restart, want %d", size, complete)
+	}
+	appendTestMeasurements(t, s, "aa:bb:cc:dd:ee:03")
+	checkMacs(t, drainTestSpool(t, s), "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03")
+}
+
+func TestSpoolOffsetPastEnd(t *testing.T) {
+	// A crash after the spool file was emptied but before the offset was reset
+	c := SpoolConfig{Dir: t.TempDir(), MaxBytes: defaultSpoolMaxBytes}
+	if err := os.WriteFile(filepath.Join(c.Dir, spoolFileName), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(c.Dir, spoolOffsetFileName), []byte("512"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestSpool(t, c)
+	if s.offset != 0 || s.depth() != 0 {
+		t.Fatalf("spool after the restart has offset %d and depth %d, want 0 and 0", s.offset, s.depth())
+	}
+	appendTestMeasurements(t, s, "aa:bb:cc:dd:ee:01")
+	checkMacs(t, drainTestSpool(t, s), "aa:bb:cc:dd:ee:01")
+}
+
+func TestSpoolInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		spool  string
+		offset string
+	}{
+		{name: "invalid offset", offset: "twelve"},
+		{name: "invalid entry", spool: "not json\n"},
+		{name: "invalid entry after the offset", spool: `{"spooledAt":"2024-01-01T00:00:00Z","measurement":{}}` + "\nnot json\n", offset: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := SpoolConfig{Dir: t.TempDir(), MaxBytes: defaultSpoolMaxBytes}
+			if err := os.WriteFile(filepath.Join(c.Dir, spoolFileName), []byte(tt.spool), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.offset != "" {
+				if err := os.WriteFile(filepath.Join(c.Dir, spoolOffsetFileName), []byte(tt.offset), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if s, err := openSpool(c); err == nil {
+				s.file.Close()
+				t.Errorf("openSpool() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	c := SpoolConfig{Dir: t.TempDir(), MaxBytes: defaultSpoolMaxBytes}
+	s := openTestSpool(t, c)
+	appendTestMeasurements(t, s, "aa:bb:cc:dd:ee:01")
+	// Room for half of another entry, their sizes differ by a few bytes of the timestamps
+	s.maxBytes = s.size + s.size/2
+	if err := s.append(&MeasurementJson{MAC: "aa:bb:cc:dd:ee:02"}); !errors.Is(err, errSpoolFull) {
+		t.Fatalf("append() error = %v, want %v", err, errSpoolFull)
+	}
+	checkMacs(t, drainTestSpool(t, s), "aa:bb:cc:dd:ee:01")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite copy of the measurements, e.g. for a file that is easy to take off a Raspberry Pi. Measurements
+// are bucketed and merged like in Postgres. There is no device table, rows are keyed by MAC and carry the
+// label of the device. The driver is pure Go, so it works in binaries built with CGO_ENABLED=0.
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS measurement (
+    mac TEXT NOT NULL,
+    label TEXT,
+    created_at TIMESTAMP NOT NULL,
+    temperature REAL,
+    humidity REAL,
+    pressure INTEGER,
+    acceleration_x INTEGER,
+    acceleration_y INTEGER,
+    acceleration_z INTEGER,
+    battery_voltage INTEGER,
+    tx_power INTEGER,
+    movement_counter INTEGER,
+    measurement_sequence_number INTEGER,
+    rssi INTEGER,
+    gateway TEXT,
+    sample_count INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (mac, created_at)
+)`
+
+// sqliteColumns are the value columns of measurement, in the order of sqliteValues
+var sqliteColumns = []string{
+	"temperature", "humidity", "pressure", "acceleration_x", "acceleration_y", "acceleration_z", "battery_voltage",
+	"tx_power", "movement_counter", "measurement_sequence_number", "rssi", "gateway",
+}
+
+// sqliteAveraged are the columns that MergeAverage averages, the others take the latest value. Each has a
+// <column>_count of the readings behind its value, see averagedColumns.
+var sqliteAveraged = map[string]bool{
+	"temperature": true, "humidity": true, "pressure": true, "acceleration_x": true, "acceleration_y": true,
+	"acceleration_z": true, "battery_voltage": true, "rssi": true,
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	sqlite, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer anyway
+	sqlite.SetMaxOpenConns(1)
+	if _, err := sqlite.Exec(sqliteSchema); err != nil {
+		sqlite.Close()
+		return nil, err
+	}
+	if err := addSQLiteCountColumns(sqlite); err != nil {
+		sqlite.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: sqlite}, nil
+}
+
+// addSQLiteCountColumns adds the count columns of the averaged columns that the file does not have yet
+func addSQLiteCountColumns(sqlite *sql.DB) error {
+	rows, err := sqlite.Query("SELECT name FROM pragma_table_info('measurement')")
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range sqliteCountColumns() {
+		if existing[column] {
+			continue
+		}
+		if _, err := sqlite.Exec(fmt.Sprintf("ALTER TABLE measurement ADD COLUMN %s INTEGER", column)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteCountColumns are the count columns of the averaged columns, in the order of sqliteColumns
+func sqliteCountColumns() []string {
+	columns := []string{}
+	for _, column := range sqliteColumns {
+		if sqliteAveraged[column] {
+			columns = append(columns, column+"_count")
+		}
+	}
+	return columns
+}
+
+func sqliteValues(m *MeasurementJson) []any {
+	return []any{
+		m.Temperature, m.Humidity, m.Pressure, m.AccelerationX, m.AccelerationY, m.AccelerationZ, m.Battery,
+		m.TxPower, m.MovementCounter, m.MeasurementSequenceNumber, m.Rssi, m.Gateway,
+	}
+}
+
+// sqliteCounts are the values of sqliteCountColumns for a single reading
+func sqliteCounts(m *MeasurementJson) []any {
+	return []any{
+		readingCount(m.Temperature), readingCount(m.Humidity), readingCount(m.Pressure), readingCount(m.AccelerationX),
+		readingCount(m.AccelerationY), readingCount(m.AccelerationZ), readingCount(m.Battery), readingCount(m.Rssi),
+	}
+}
+
+// sqliteConflict returns the ON CONFLICT clause of the merge strategy, see lastAssignments and averageAssignments
+func sqliteConflict(merge string) string {
+	assignments := []string{}
+	for _, column := range sqliteColumns {
+		value := fmt.Sprintf("COALESCE(excluded.%[1]s, measurement.%[1]s)", column)
+		if merge == MergeAverage && sqliteAveraged[column] {
+			average := fmt.Sprintf("(measurement.%[1]s * %[2]s + excluded.%[1]s) * 1.0 / (%[2]s + 1)", column, storedCount(column))
+			if column != "temperature" && column != "humidity" {
+				average = fmt.Sprintf("CAST(ROUND(%s) AS INTEGER)", average)
+			}
+			value = fmt.Sprintf("COALESCE(%s, excluded.%[2]s, measurement.%[2]s)", average, column)
+		}
+		assignments = append(assignments, fmt.Sprintf("%s = %s", column, value))
+	}
+	for _, column := range sqliteColumns {
+		if !sqliteAveraged[column] {
+			continue
+		}
+		count := fmt.Sprintf("CASE WHEN excluded.%[1]s IS NULL THEN measurement.%[1]s_count ELSE 1 END", column)
+		if merge == MergeAverage {
+			count = fmt.Sprintf("%s + CASE WHEN excluded.%s IS NULL THEN 0 ELSE 1 END", storedCount(column), column)
+		}
+		assignments = append(assignments, fmt.Sprintf("%s_count = %s", column, count))
+	}
+	assignments = append(assignments, "label = excluded.label", "sample_count = measurement.sample_count + 1")
+	return "ON CONFLICT (mac, created_at) DO UPDATE SET " + strings.Join(assignments, ", ")
+}
+
+func (s *sqliteStore) Write(device model.Device, m *MeasurementJson) (bool, error) {
+	rule := bucketRule(device)
+	createdAt := time.Now()
+	if m.Timestamp != nil {
+		createdAt = *m.Timestamp
+	}
+
+	conflict := "ON CONFLICT (mac, created_at) DO NOTHING"
+	switch rule.Merge {
+	case MergeLast, MergeAverage:
+		conflict = sqliteConflict(rule.Merge)
+	}
+	columns := append(slices.Clone(sqliteColumns), sqliteCountColumns()...)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)+3), ", ")
+	insert := fmt.Sprintf("INSERT INTO measurement (mac, label, created_at, %s) VALUES (%s) %s",
+		strings.Join(columns, ", "), placeholders, conflict)
+
+	args := append([]any{device.Mac, device.Label, rule.bucketTime(createdAt).UTC()}, sqliteValues(m)...)
+	args = append(args, sqliteCounts(m)...)
+	result, err := s.db.Exec(insert, args...)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Data forwarding of the Ruuvi Station mobile app. The app posts the tags it sees to a custom URL
+// and may forward the same event again, so events are deduplicated by their eventId.
+
+// RuuviStationJson is the document the app posts
+type RuuviStationJson struct {
+	// DeviceID identifies the phone running the app
+	DeviceID string            `json:"deviceId"`
+	EventID  string            `json:"eventId"`
+	Time     *stationTime      `json:"time"`
+	Tags     []RuuviStationTag `json:"tags"`
+}
+
+// RuuviStationTag is one tag as decoded by the app. Acceleration is in g and voltage in V.
+type RuuviStationTag struct {
+	ID                        string       `json:"id"`
+	Name                      string       `json:"name"`
+	Temperature               *float64     `json:"temperature"`
+	Humidity                  *float64     `json:"humidity"`
+	Pressure                  *float64     `json:"pressure"`
+	AccelX                    *float64     `json:"accelX"`
+	AccelY                    *float64     `json:"accelY"`
+	AccelZ                    *float64     `json:"accelZ"`
+	Voltage                   *float64     `json:"voltage"`
+	TxPower                   *float64     `json:"txPower"`
+	MovementCounter           *int64       `json:"movementCounter"`
+	MeasurementSequenceNumber *int64       `json:"measurementSequenceNumber"`
+	Rssi                      *int32       `json:"rssi"`
+	UpdateAt                  *stationTime `json:"updateAt"`
+}
+
+// stationTime accepts RFC 3339 as well as the numeric zone offset (+0200) that the app uses
+type stationTime struct {
+	time.Time
+}
+
+var stationTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05.000-0700",
+}
+
+func (t *stationTime) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		return nil
+	}
+	for _, layout := range stationTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %s", data)
+}
+
+// toMeasurement maps the tag onto MeasurementJson in the units of data format 5
+func (tag RuuviStationTag) toMeasurement() *MeasurementJson {
+	m := &MeasurementJson{
+		MAC:                       tag.ID,
+		Temperature:               tag.Temperature,
+		Humidity:                  tag.Humidity,
+		MovementCounter:           tag.MovementCounter,
+		MeasurementSequenceNumber: tag.MeasurementSequenceNumber,
+		Rssi:                      tag.Rssi,
+	}
+	if tag.Pressure != nil {
+		// Older versions of the app forward hPa instead of Pa
+		pressure := *tag.Pressure
+		if pressure < 2000 {
+			pressure *= 100
+		}
+		m.Pressure = roundToInt32(pressure, 1)
+	}
+	if tag.AccelX != nil {
+		m.AccelerationX = roundToInt32(*tag.AccelX, 1000)
+	}
+	if tag.AccelY != nil {
+		m.AccelerationY = roundToInt32(*tag.AccelY, 1000)
+	}
+	if tag.AccelZ != nil {
+		m.AccelerationZ = roundToInt32(*tag.AccelZ, 1000)
+	}
+	if tag.Voltage != nil {
+		m.Battery = roundToInt32(*tag.Voltage, 1000)
+	}
+	if tag.TxPower != nil {
+		m.TxPower = roundToInt32(*tag.TxPower, 1)
+	}
+	if tag.UpdateAt != nil && !tag.UpdateAt.IsZero() {
+		m.Timestamp = &tag.UpdateAt.Time
+	}
+	return m
+}
+
+func roundToInt32(value float64, scale float64) *int32 {
+	rounded := int32(math.Round(value * scale))
+	return &rounded
+}
+
+// recordStationEvent remembers the event and returns false when it has been seen before
+func recordStationEvent(s *RuuviStationJson) (bool, error) {
+	event := model.StationEvent{EventID: s.EventID}
+	if s.DeviceID != "" {
+		event.StationID = &s.DeviceID
+	}
+	insertStmt := StationEvent.INSERT(StationEvent.EventID, StationEvent.StationID).
+		MODEL(event).
+		ON_CONFLICT(StationEvent.EventID).
+		DO_NOTHING()
+	result, err := insertStmt.Exec(db)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted > 0, nil
+}
+
+func forgetStationEvent(eventID string) {
+	deleteStmt := StationEvent.DELETE().WHERE(StationEvent.EventID.EQ(String(eventID)))
+	if _, err := deleteStmt.Exec(db); err != nil {
+		log.Error().Err(err).Msgf("Failed to forget Ruuvi Station event %s", eventID)
+	}
+}
+
+// deleteStationEvents forgets the events received before the cutoff
+func deleteStationEvents(cutoff time.Time) {
+	deleteStmt := StationEvent.DELETE().WHERE(StationEvent.ReceivedAt.LT(TimestampzT(cutoff)))
+	result, err := deleteStmt.Exec(db)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete old Ruuvi Station events")
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Info().Msgf("Deleted %d Ruuvi Station events received before %s", rows, cutoff.Format(time.RFC3339))
+	}
+}
+
+// postStationMeasurements stores the tags of a Ruuvi Station event as one batch. An event that has
+// already been stored is acknowledged without storing it again.
+func postStationMeasurements(c echo.Context) error {
+	s := new(RuuviStationJson)
+	if err := json.NewDecoder(c.Request().Body).Decode(s); err != nil {
+		log.Error().Err(err).Msgf("Failed to bind payload into Ruuvi Station data")
+		countRejected(RejectReasonInvalidPayload)
+		return echo.NewHTTPError(400, "Invalid data")
+	}
+	if len(s.Tags) > maxBatchSize {
+		return echo.NewHTTPError(400, fmt.Sprintf("Invalid data: batch size is limited to %d", maxBatchSize))
+	}
+
+	if s.EventID != "" {
+		isNew, err := recordStationEvent(s)
+		if err != nil {
+			// The measurements are spooled while Postgres is down, a duplicate event only merges into the same buckets
+			dbErrorCounter.Inc()
+			log.Error().Err(err).Msgf("Failed to record Ruuvi Station event %s, storing it without deduplication", s.EventID)
+			isNew = true
+		}
+		if !isNew {
+			log.Info().Msgf("Ruuvi Station event %s has already been stored, skipping it", s.EventID)
+			return c.NoContent(200)
+		}
+	}
+
+	batch := make([]*MeasurementJson, len(s.Tags))
+	for i, tag := range s.Tags {
+		m := tag.toMeasurement()
+		if m.Timestamp == nil && s.Time != nil && !s.Time.IsZero() {
+			m.Timestamp = &s.Time.Time
+		}
+		if s.DeviceID != "" {
+			m.Gateway = &s.DeviceID
+		} else {
+			m.Gateway = requestIdentity(c)
+		}
+		batch[i] = m
+	}
+	log.Info().Msgf("Received %d measurements from Ruuvi Station %s", len(batch), s.DeviceID)
+
+	results, err := storeMeasurementBatch(batch)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to write Ruuvi Station data")
+		// Let the app forward the event again
+		if s.EventID != "" {
+			forgetStationEvent(s.EventID)
+		}
+		return echo.NewHTTPError(500, "Failed to write data")
+	}
+
+	return c.JSON(200, results)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	"github.com/go-jet/jet/v2/qrm"
+	"github.com/rs/zerolog/log"
+)
+
+// Storage backends for measurements. The first configured backend is the primary and must be Postgres: its result is what
+// clients get, and only measurements that it stores are published. Every accepted measurement is also
+// fanned out to the other backends, each from its own queue so that a slow or unavailable backend does
+// not hold up ingestion.
+//
+// Devices, tokens, quarantine, rollups and the query API all work on Postgres, SQLite and InfluxDB only
+// keep copies of the measurements.
+
+const (
+	StorageTypePostgres = "postgres"
+	StorageTypeSQLite   = "sqlite"
+	StorageTypeInfluxDB = "influxdb"
+
+	defaultStorageQueueSize = 1000
+)
+
+// MeasurementStore is a backend that measurements of known devices are written to
+type MeasurementStore interface {
+	// Write stores the measurement and returns whether it was written. It is false when the measurement
+	// is merged away, e.g. a duplicate in a bucket that keeps its first reading.
+	Write(device model.Device, m *MeasurementJson) (bool, error)
+}
+
+type StorageConfig struct {
+	// Backends are written in this order, the first one is the primary and must be postgres
+	Backends []BackendConfig `yaml:"backends"`
+}
+
+type BackendConfig struct {
+	Type string `yaml:"type"`
+	// Name tells backends of the same type apart in logs and metrics, the type by default
+	Name string `yaml:"name"`
+	// QueueSize is the number of measurements waiting for a secondary backend before new ones are dropped
+	QueueSize int `yaml:"queueSize"`
+
+	// Path of the SQLite database file
+	Path string `yaml:"path"`
+
+	// URL of the InfluxDB server
+	URL string `yaml:"url"`
+	// Org and Bucket select the InfluxDB 2 API, Database the InfluxDB 1 API
+	Org      string `yaml:"org"`
+	Bucket   string `yaml:"bucket"`
+	Database string `yaml:"database"`
+	// Measurement is the InfluxDB measurement name, ruuvi by default
+	Measurement string `yaml:"measurement"`
+	// TokenEnv is the .env variable that holds the InfluxDB token, INFLUXDB_TOKEN by default
+	TokenEnv string `yaml:"tokenEnv"`
+}
+
+type storageBackend struct {
+	name  string
+	store MeasurementStore
+	queue chan storedMeasurement
+}
+
+type storedMeasurement struct {
+	device model.Device
+	m      *MeasurementJson
+}
+
+var secondaryStores []storageBackend
+
+func defaultStorageConfig() StorageConfig {
+	return StorageConfig{Backends: []BackendConfig{{Type: StorageTypePostgres}}}
+}
+
+func (c BackendConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+func checkStorageConfig(c StorageConfig) error {
+	if len(c.Backends) == 0 {
+		return fmt.Errorf("storage needs at least one backend")
+	}
+	if c.Backends[0].Type != StorageTypePostgres {
+		return fmt.Errorf("the first storage backend must be %s, devices, tokens and the query API need it, %s and %s can only keep copies",
+			StorageTypePostgres, StorageTypeSQLite, StorageTypeInfluxDB)
+	}
+	names := map[string]bool{}
+	for _, backend := range c.Backends {
+		if names[backend.name()] {
+			return fmt.Errorf("storage backend %s is configured twice, give them different names", backend.name())
+		}
+		names[backend.name()] = true
+
+		if backend.QueueSize < 0 {
+			return fmt.Errorf("storage backend %s: queueSize must not be negative", backend.name())
+		}
+		switch backend.Type {
+		case StorageTypePostgres:
+			if backend.Name != "" && backend.Name != StorageTypePostgres {
+				return fmt.Errorf("storage backend %s: there can only be one postgres backend", backend.name())
+			}
+		case StorageTypeSQLite:
+			if backend.Path == "" {
+				return fmt.Errorf("storage backend %s: path is missing", backend.name())
+			}
+		case StorageTypeInfluxDB:
+			if backend.URL == "" {
+				return fmt.Errorf("storage backend %s: url is missing", backend.name())
+			}
+			if backend.Bucket == "" && backend.Database == "" {
+				return fmt.Errorf("storage backend %s: either bucket and org or database is needed", backend.name())
+			}
+		default:
+			return fmt.Errorf("unknown storage backend type %s, use %s, %s or %s", backend.Type, StorageTypePostgres, StorageTypeSQLite, StorageTypeInfluxDB)
+		}
+	}
+	return nil
+}
+
+// openStorage opens the configured backends and starts the queues of the secondary ones
+func openStorage() error {
+	for i, c := range config.Storage.Backends {
+		var store MeasurementStore
+		var err error
+		switch c.Type {
+		case StorageTypePostgres:
+			store = postgresStore{}
+		case StorageTypeSQLite:
+			store, err = openSQLiteStore(c.Path)
+		case StorageTypeInfluxDB:
+			store = newInfluxStore(c)
+		}
+		if err != nil {
+			return fmt.Errorf("storage backend %s: %w", c.name(), err)
+		}
+
+		backend := storageBackend{name: c.name(), store: store}
+		if i == 0 {
+			log.Info().Msgf("Storing measurements in %s", backend.name)
+			continue
+		}
+		queueSize := c.QueueSize
+		if queueSize == 0 {
+			queueSize = defaultStorageQueueSize
+		}
+		backend.queue = make(chan storedMeasurement, queueSize)
+		secondaryStores = append(secondaryStores, backend)
+		go backend.run()
+		log.Info().Msgf("Also storing measurements in %s", backend.name)
+	}
+	return nil
+}
+
+// writePrimary writes the measurement to Postgres through the given database, so that it is part of the
+// transaction of a batch
+func writePrimary(db qrm.DB, device model.Device, m *MeasurementJson) (bool, error) {
+	return writeMeasurement(db, device, m)
+}
+
+// fanOut queues the measurement for the secondary backends
+func fanOut(device model.Device, m *MeasurementJson) {
+	if len(secondaryStores) == 0 {
+		return
+	}
+	// The backends write later, they must not take the time of writing as the time of the reading
+	queued := *m
+	if queued.Timestamp == nil {
+		now := time.Now()
+		queued.Timestamp = &now
+	}
+	for _, backend := range secondaryStores {
+		select {
+		case backend.queue <- storedMeasurement{device: device, m: &queued}:
+		default:
+			storageDroppedCounter.WithLabelValues(backend.name).Inc()
+			log.Error().Msgf("Queue of storage backend %s is full, dropping measurement of %s", backend.name, m.MAC)
+		}
+	}
+}
+
+// run writes the queued measurements to the backend in the order they were accepted
+func (b storageBackend) run() {
+	for item := range b.queue {
+		if _, err := b.store.Write(item.device, item.m); err != nil {
+			storageErrorCounter.WithLabelValues(b.name).Inc()
+			log.Error().Err(err).Msgf("Failed to write data for %s to %s", item.m.MAC, b.name)
+		}
+	}
+}
+
+// postgresStore writes to the measurement table, see writeMeasurement
+type postgresStore struct{}
+
+func (postgresStore) Write(device model.Device, m *MeasurementJson) (bool, error) {
+	return writeMeasurement(db, device, m)
+}
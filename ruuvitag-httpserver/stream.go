@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Live stream of stored measurements over Server-Sent Events and WebSocket
+
+const (
+	streamBufferSize   = 64
+	streamPingInterval = 30 * time.Second
+)
+
+// StreamMeasurement is a stored measurement together with the label of its device
+type StreamMeasurement struct {
+	MeasurementJson
+	Label string `json:"label"`
+}
+
+type streamFilter struct {
+	macs   []string
+	labels []string
+}
+
+func (f streamFilter) matches(sm StreamMeasurement) bool {
+	if len(f.macs) > 0 && !slices.Contains(f.macs, strings.ToLower(sm.MAC)) {
+		return false
+	}
+	if len(f.labels) > 0 && !slices.Contains(f.labels, sm.Label) {
+		return false
+	}
+	return true
+}
+
+// parseStreamFilter reads comma separated device (MAC) and label query parameters
+func parseStreamFilter(c echo.Context) streamFilter {
+	f := streamFilter{}
+	if devices := c.QueryParam("device"); devices != "" {
+		for _, mac := range strings.Split(devices, ",") {
+			f.macs = append(f.macs, strings.ToLower(mac))
+		}
+	}
+	if labels := c.QueryParam("label"); labels != "" {
+		f.labels = strings.Split(labels, ",")
+	}
+	return f
+}
+
+type streamHub struct {
+	lock        sync.RWMutex
+	subscribers map[chan StreamMeasurement]struct{}
+	// latest holds the last known value per device by lowercase MAC
+	latest map[string]StreamMeasurement
+}
+
+var hub = &streamHub{
+	subscribers: map[chan StreamMeasurement]struct{}{},
+	latest:      map[string]StreamMeasurement{},
+}
+
+// subscribe returns a channel for new measurements and the last known value of each device
+func (h *streamHub) subscribe() (chan StreamMeasurement, []StreamMeasurement) {
+	ch := make(chan StreamMeasurement, streamBufferSize)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.subscribers[ch] = struct{}{}
+	latest := []StreamMeasurement{}
+	for _, sm := range h.latest {
+		latest = append(latest, sm)
+	}
+	return ch, latest
+}
+
+func (h *streamHub) unsubscribe(ch chan StreamMeasurement) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.subscribers, ch)
+}
+
+// last returns the last known value of the device
+func (h *streamHub) last(mac string) (StreamMeasurement, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	sm, ok := h.latest[strings.ToLower(mac)]
+	return sm, ok
+}
+
+// publish sends the measurement to all subscribers. Subscribers that cannot keep up miss measurements.
+func (h *streamHub) publish(sm StreamMeasurement) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.latest[strings.ToLower(sm.MAC)] = sm
+	for ch := range h.subscribers {
+		select {
+		case ch <- sm:
+		default:
+			log.Warn().Msgf("Stream subscriber is too slow, dropping measurement of %s", sm.MAC)
+		}
+	}
+}
+
+func publishStream(device model.Device, m *MeasurementJson) {
+	sm := StreamMeasurement{MeasurementJson: *m, Label: device.Label}
+	sm.MAC = device.Mac
+	if sm.Timestamp == nil {
+		now := time.Now()
+		sm.Timestamp = &now
+	}
+	hub.publish(sm)
+}
+
+// getStream streams measurements as Server-Sent Events
+func getStream(c echo.Context) error {
+	filter := parseStreamFilter(c)
+	ch, latest := hub.subscribe()
+	defer hub.unsubscribe(ch)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(200)
+
+	writeEvent := func(sm StreamMeasurement) error {
+		data, err := json.Marshal(sm)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: measurement\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}
+
+	for _, sm := range latest {
+		if filter.matches(sm) {
+			if err := writeEvent(sm); err != nil {
+				return nil
+			}
+		}
+	}
+	w.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		case sm := <-ch:
+			if filter.matches(sm) {
+				if err := writeEvent(sm); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	// Dashboards may be served from elsewhere and the stream is read only
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// getWebSocket streams measurements as WebSocket text messages
+func getWebSocket(c echo.Context) error {
+	filter := parseStreamFilter(c)
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to upgrade to WebSocket")
+		return nil
+	}
+	defer conn.Close()
+
+	ch, latest := hub.subscribe()
+	defer hub.unsubscribe(ch)
+
+	// Incoming messages are not used, reading just notices when the client goes away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, sm := range latest {
+		if filter.matches(sm) {
+			if err := conn.WriteJSON(sm); err != nil {
+				return nil
+			}
+		}
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return nil
+			}
+		case sm := <-ch:
+			if filter.matches(sm) {
+				if err := conn.WriteJSON(sm); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
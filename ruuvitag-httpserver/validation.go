@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+	. "ruuvitag-httpserver/.gen/ruuvi/public/table"
+
+	. "github.com/go-jet/jet/v2/postgres"
+	"github.com/go-jet/jet/v2/qrm"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Plausibility validation of incoming measurements. Each field may have a range and a maximum rate
+// of change, globally and per device. Rates are from the previous accepted reading of the device, which
+// is read from the measurement table once after a restart.
+
+const (
+	ValidationRuleMin  = "min"
+	ValidationRuleMax  = "max"
+	ValidationRuleRate = "maxRatePerMinute"
+)
+
+// FieldRule limits the values of one field. Limits that are not set are not checked.
+type FieldRule struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+	// MaxRatePerMinute limits the change from the previous accepted reading of the device
+	MaxRatePerMinute *float64 `yaml:"maxRatePerMinute"`
+}
+
+type ValidationConfig struct {
+	// StoreRejected keeps rejected readings in rejected_measurement
+	StoreRejected bool `yaml:"storeRejected"`
+	// Fields replace the default rule of the field
+	Fields map[string]FieldRule `yaml:"fields"`
+	// Devices replace rules of single fields for a device, given by MAC or label
+	Devices map[string]map[string]FieldRule `yaml:"devices"`
+}
+
+// Violation is one rule that a measurement breaks
+type Violation struct {
+	Field   string  `json:"field"`
+	Rule    string  `json:"rule"`
+	Value   float64 `json:"value"`
+	Limit   float64 `json:"limit"`
+	Message string  `json:"message"`
+}
+
+// ValidationError is returned for implausible measurements and sent to clients as a 422 response
+type ValidationError struct {
+	Message    string      `json:"message"`
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Message, strings.Join(messages, ", "))
+}
+
+var (
+	// previousReadings are the latest accepted readings by lowercase MAC, guarded by previousLock. A nil
+	// reading is a device without stored readings.
+	previousReadings = map[string]*MeasurementJson{}
+	previousLock     sync.Mutex
+)
+
+// validationFields are the fields that can be validated, in the units of MeasurementJson
+var validationFields = map[string]func(m *MeasurementJson) *float64{
+	"temperature":   func(m *MeasurementJson) *float64 { return m.Temperature },
+	"humidity":      func(m *MeasurementJson) *float64 { return m.Humidity },
+	"pressure":      func(m *MeasurementJson) *float64 { return int32Value(m.Pressure) },
+	"battery":       func(m *MeasurementJson) *float64 { return int32Value(m.Battery) },
+	"accelerationX": func(m *MeasurementJson) *float64 { return int32Value(m.AccelerationX) },
+	"accelerationY": func(m *MeasurementJson) *float64 { return int32Value(m.AccelerationY) },
+	"accelerationZ": func(m *MeasurementJson) *float64 { return int32Value(m.AccelerationZ) },
+	"txPower":       func(m *MeasurementJson) *float64 { return int32Value(m.TxPower) },
+	"rssi":          func(m *MeasurementJson) *float64 { return int32Value(m.Rssi) },
+}
+
+func int32Value(value *int32) *float64 {
+	if value == nil {
+		return nil
+	}
+	f := float64(*value)
+	return &f
+}
+
+func limit(value float64) *float64 {
+	return &value
+}
+
+// defaultValidationFields are the operating ranges of the RuuviTag sensors
+func defaultValidationFields() map[string]FieldRule {
+	return map[string]FieldRule{
+		"temperature": {Min: limit(-40), Max: limit(85)},
+		"humidity":    {Min: limit(0), Max: limit(100)},
+		"pressure":    {Min: limit(50000), Max: limit(115536)},
+		"battery":     {Min: limit(1600), Max: limit(3647)},
+	}
+}
+
+func checkValidationConfig(c ValidationConfig) error {
+	check := func(fields map[string]FieldRule) error {
+		for field := range fields {
+			if _, ok := validationFields[field]; !ok {
+				return fmt.Errorf("unknown validation field %s", field)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Fields); err != nil {
+		return err
+	}
+	for _, fields := range c.Devices {
+		if err := check(fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validationRule returns the rule of the field for the device. The rule of the device by MAC takes precedence
+// over the one by label, and both over the global rule.
+func validationRule(mac string, label string, field string) (FieldRule, bool) {
+	for key, fields := range config.Validation.Devices {
+		if strings.EqualFold(key, mac) || normalizedMacEquals(key, mac) {
+			if rule, ok := fields[field]; ok {
+				return rule, true
+			}
+		}
+	}
+	if label != "" {
+		if rule, ok := config.Validation.Devices[label][field]; ok {
+			return rule, true
+		}
+	}
+	rule, ok := config.Validation.Fields[field]
+	return rule, ok
+}
+
+// validateMeasurement checks the measurement against the rules and returns a *ValidationError listing
+// every violated rule
+func validateMeasurement(m *MeasurementJson) error {
+	mac, err := normalizeMac(m.MAC)
+	if err != nil {
+		// The MAC is checked when the measurement is stored
+		mac = m.MAC
+	}
+	// Only the cache, an unloaded cache must not cost a query per measurement
+	device, known := cachedDevice(mac)
+	var previous *MeasurementJson
+	previousRead := false
+
+	fields := make([]string, 0, len(validationFields))
+	for field := range validationFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	violations := []Violation{}
+	for _, field := range fields {
+		value := validationFields[field](m)
+		if value == nil {
+			continue
+		}
+		rule, ok := validationRule(mac, device.Label, field)
+		if !ok {
+			continue
+		}
+
+		if rule.Min != nil && *value < *rule.Min {
+			violations = append(violations, Violation{Field: field, Rule: ValidationRuleMin, Value: *value, Limit: *rule.Min,
+				Message: fmt.Sprintf("%s %g is below %g", field, *value, *rule.Min)})
+		}
+		if rule.Max != nil && *value > *rule.Max {
+			violations = append(violations, Violation{Field: field, Rule: ValidationRuleMax, Value: *value, Limit: *rule.Max,
+				Message: fmt.Sprintf("%s %g is above %g", field, *value, *rule.Max)})
+		}
+		if rule.MaxRatePerMinute != nil && !previousRead {
+			previous = previousReading(mac, device, known)
+			previousRead = true
+		}
+		if rule.MaxRatePerMinute != nil && previous != nil {
+			if rate, ok := ratePerMinute(previous, m, validationFields[field]); ok && rate > *rule.MaxRatePerMinute {
+				violations = append(violations, Violation{Field: field, Rule: ValidationRuleRate, Value: rate, Limit: *rule.MaxRatePerMinute,
+					Message: fmt.Sprintf("%s changes %.2f per minute, more than %g", field, rate, *rule.MaxRatePerMinute)})
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return &ValidationError{Message: "Implausible measurement", Violations: violations}
+	}
+	rememberReading(mac, m)
+	return nil
+}
+
+// previousReading returns the previous accepted reading of the device, nil when there is none. Known
+// devices without one in memory get their latest stored reading.
+func previousReading(mac string, device model.Device, known bool) *MeasurementJson {
+	key := strings.ToLower(mac)
+	previousLock.Lock()
+	previous, ok := previousReadings[key]
+	previousLock.Unlock()
+	if ok || !known {
+		return previous
+	}
+
+	var latest model.Measurement
+	stmt := SELECT(Measurement.AllColumns).
+		FROM(Measurement).
+		WHERE(Measurement.DeviceID.EQ(Int32(device.ID))).
+		ORDER_BY(Measurement.CreatedAt.DESC()).
+		LIMIT(1)
+	err := stmt.Query(db, &latest)
+	switch {
+	case err == nil:
+		previous = storedToMeasurement(device, latest)
+	case !errors.Is(err, qrm.ErrNoRows):
+		// Not tried again, the next accepted reading is compared from then on
+		log.Error().Err(err).Msgf("Failed to read the latest measurement of %s for its rates", mac)
+	}
+
+	previousLock.Lock()
+	defer previousLock.Unlock()
+	if current, ok := previousReadings[key]; ok {
+		return current
+	}
+	previousReadings[key] = previous
+	return previous
+}
+
+// rememberReading keeps the accepted reading for the rates of the next one, unless a newer one is kept
+func rememberReading(mac string, m *MeasurementJson) {
+	reading := *m
+	at := measurementTime(m)
+	reading.Timestamp = &at
+
+	previousLock.Lock()
+	defer previousLock.Unlock()
+	key := strings.ToLower(mac)
+	if previous := previousReadings[key]; previous == nil || at.After(*previous.Timestamp) {
+		previousReadings[key] = &reading
+	}
+}
+
+func storedToMeasurement(device model.Device, s model.Measurement) *MeasurementJson {
+	createdAt := s.CreatedAt
+	return &MeasurementJson{
+		MAC:                       device.Mac,
+		Temperature:               s.Temperature,
+		Humidity:                  s.Humidity,
+		Pressure:                  s.Pressure,
+		AccelerationX:             s.AccelerationX,
+		AccelerationY:             s.AccelerationY,
+		AccelerationZ:             s.AccelerationZ,
+		Battery:                   s.BatteryVoltage,
+		TxPower:                   s.TxPower,
+		MovementCounter:           s.MovementCounter,
+		MeasurementSequenceNumber: s.MeasurementSequenceNumber,
+		Rssi:                      s.Rssi,
+		Gateway:                   s.Gateway,
+		Timestamp:                 &createdAt,
+	}
+}
+
+// ratePerMinute returns the absolute change of the field between the readings. Readings closer than
+// a minute count as a minute apart, so that sensor noise between quick readings does not trip the
+// limit. Older readings, e.g. from a backfill, are not compared.
+func ratePerMinute(previous *MeasurementJson, m *MeasurementJson, value func(*MeasurementJson) *float64) (float64, bool) {
+	previousValue, currentValue := value(previous), value(m)
+	if previousValue == nil || currentValue == nil || previous.Timestamp == nil {
+		return 0, false
+	}
+	now := time.Now()
+	if m.Timestamp != nil {
+		now = *m.Timestamp
+	}
+	elapsed := now.Sub(*previous.Timestamp)
+	if elapsed < 0 {
+		return 0, false
+	}
+	minutes := math.Max(elapsed.Minutes(), 1)
+	return math.Abs(*currentValue-*previousValue) / minutes, true
+}
+
+// rejectMeasurement counts the rejected measurement and keeps it when configured to
+func rejectMeasurement(m *MeasurementJson, validationErr *ValidationError) {
+	countRejected(RejectReasonImplausible)
+	for _, v := range validationErr.Violations {
+		violationCounter.WithLabelValues(v.Field, v.Rule).Inc()
+	}
+	log.Warn().Msgf("Rejected measurement of %s: %v", m.MAC, validationErr)
+
+	if config.Validation.StoreRejected {
+		storeRejectedMeasurement(m, validationErr.Violations)
+	}
+}
+
+// storeRejectedMeasurement keeps the measurement and why it was rejected in rejected_measurement
+func storeRejectedMeasurement(m *MeasurementJson, violations []Violation) {
+	measurementData, err := json.Marshal(m)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal rejected measurement")
+		return
+	}
+	violationData, err := json.Marshal(violations)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal violations")
+		return
+	}
+
+	rejected := model.RejectedMeasurement{Measurement: string(measurementData), Violations: string(violationData)}
+	if m.MAC != "" {
+		rejected.Mac = &m.MAC
+	}
+	insertStmt := RejectedMeasurement.
+		INSERT(RejectedMeasurement.Mac, RejectedMeasurement.Measurement, RejectedMeasurement.Violations).
+		MODEL(rejected)
+	if _, err := insertStmt.Exec(db); err != nil {
+		dbErrorCounter.Inc()
+		log.Error().Err(err).Msgf("Failed to store rejected measurement of %s", m.MAC)
+	}
+}
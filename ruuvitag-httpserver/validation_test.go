@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"ruuvitag-httpserver/.gen/ruuvi/public/model"
+)
+
+// setupValidation validates with the rules against an empty device cache and no previous readings
+func setupValidation(t *testing.T, c ValidationConfig) {
+	t.Helper()
+	previousConfig, previousDevices := config, devices
+	config = defaultConfig()
+	config.Validation = c
+	devices = map[string]model.Device{}
+	previousReadings = map[string]*MeasurementJson{}
+	t.Cleanup(func() {
+		config, devices = previousConfig, previousDevices
+		previousReadings = map[string]*MeasurementJson{}
+	})
+}
+
+func reading(mac string, at time.Time, temperature float64) *MeasurementJson {
+	return &MeasurementJson{MAC: mac, Temperature: &temperature, Timestamp: &at}
+}
+
+// violations returns the field and rule of each violation, nil when the measurement is valid
+func violations(t *testing.T, err error) [][2]string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("validateMeasurement() error = %v, want a *ValidationError", err)
+	}
+	found := [][2]string{}
+	for _, v := range validationErr.Violations {
+		found = append(found, [2]string{v.Field, v.Rule})
+	}
+	return found
+}
+
+func TestValidateMeasurementRanges(t *testing.T) {
+	setupValidation(t, ValidationConfig{
+		Fields: defaultValidationFields(),
+		Devices: map[string]map[string]FieldRule{
+			"sauna":             {"temperature": {Max: limit(120)}},
+			"AA:BB:CC:DD:EE:02": {"humidity": {Max: limit(90)}},
+			"garage":            {"temperature": {Max: limit(120)}, "humidity": {Max: limit(80)}},
+			"aa-bb-cc-dd-ee-03": {"temperature": {Max: limit(50)}},
+		},
+	})
+	devices["aa:bb:cc:dd:ee:01"] = model.Device{ID: 1, Mac: "aa:bb:cc:dd:ee:01", Label: "sauna", Status: DeviceStatusActive}
+	devices["aa:bb:cc:dd:ee:03"] = model.Device{ID: 3, Mac: "aa:bb:cc:dd:ee:03", Label: "garage", Status: DeviceStatusActive}
+
+	humidity := func(m *MeasurementJson, value float64) *MeasurementJson {
+		m.Humidity = &value
+		return m
+	}
+	battery := func(m *MeasurementJson, value int32) *MeasurementJson {
+		m.Battery = &value
+		return m
+	}
+	now := time.Now()
+	tests := []struct {
+		name string
+		m    *MeasurementJson
+		want [][2]string
+	}{
+		{name: "valid", m: battery(humidity(reading("aa:bb:cc:dd:ee:00", now, 21.5), 45), 2977)},
+		{name: "missing fields", m: &MeasurementJson{MAC: "aa:bb:cc:dd:ee:00"}},
+		{name: "at the limits", m: battery(humidity(reading("aa:bb:cc:dd:ee:00", now, 85), 0), 1600)},
+		{name: "above maximum", m: reading("aa:bb:cc:dd:ee:00", now, 85.5),
+			want: [][2]string{{"temperature", ValidationRuleMax}}},
+		{name: "every violation", m: battery(humidity(reading("aa:bb:cc:dd:ee:00", now, -41), 101), 1599),
+			want: [][2]string{{"battery", ValidationRuleMin}, {"humidity", ValidationRuleMax}, {"temperature", ValidationRuleMin}}},
+		{name: "device rule by label", m: reading("aa:bb:cc:dd:ee:01", now, 100)},
+		{name: "device rule by label above maximum", m: reading("aa:bb:cc:dd:ee:01", now, 121),
+			want: [][2]string{{"temperature", ValidationRuleMax}}},
+		{name: "device rule by mac", m: humidity(reading("aa:bb:cc:dd:ee:02", now, 20), 95),
+			want: [][2]string{{"humidity", ValidationRuleMax}}},
+		{name: "device rule does not replace other fields", m: reading("aa:bb:cc:dd:ee:02", now, 90),
+			want: [][2]string{{"temperature", ValidationRuleMax}}},
+		{name: "device rule by mac before the one by label", m: reading("aa:bb:cc:dd:ee:03", now, 60),
+			want: [][2]string{{"temperature", ValidationRuleMax}}},
+		{name: "device rule by label for fields without one by mac", m: humidity(reading("aa:bb:cc:dd:ee:03", now, 20), 85),
+			want: [][2]string{{"humidity", ValidationRuleMax}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Rules must not depend on the order of the device map
+			for range 20 {
+				got := violations(t, validateMeasurement(tt.m))
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("validateMeasurement() violations = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMeasurementRate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		readings []*MeasurementJson
+		// want are the violations of the last reading
+		want [][2]string
+	}{
+		{
+			name:     "first reading",
+			readings: []*MeasurementJson{reading("aa:bb:cc:dd:ee:00", start, 20)},
+		},
+		{
+			name: "within the rate",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("aa:bb:cc:dd:ee:00", start.Add(10*time.Minute), 25),
+			},
+		},
+		{
+			name: "above the rate",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("aa:bb:cc:dd:ee:00", start.Add(2*time.Minute), 25),
+			},
+			want: [][2]string{{"temperature", ValidationRuleRate}},
+		},
+		{
+			name: "quick readings count as a minute apart",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("aa:bb:cc:dd:ee:00", start.Add(5*time.Second), 21),
+			},
+		},
+		{
+			name: "rejected readings are not compared against",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("aa:bb:cc:dd:ee:00", start.Add(time.Minute), 30),
+				reading("aa:bb:cc:dd:ee:00", start.Add(2*time.Minute), 21),
+			},
+		},
+		{
+			name: "older readings are not compared",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("aa:bb:cc:dd:ee:00", start.Add(-time.Minute), 30),
+			},
+		},
+		{
+			name: "devices are compared separately",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("aa:bb:cc:dd:ee:01", start.Add(time.Minute), 30),
+			},
+		},
+		{
+			name: "macs are compared case insensitively",
+			readings: []*MeasurementJson{
+				reading("aa:bb:cc:dd:ee:00", start, 20),
+				reading("AA:BB:CC:DD:EE:00", start.Add(time.Minute), 30),
+			},
+			want: [][2]string{{"temperature", ValidationRuleRate}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupValidation(t, ValidationConfig{
+				Fields: map[string]FieldRule{"temperature": {MaxRatePerMinute: limit(1)}},
+			})
+			var err error
+			for _, m := range tt.readings {
+				err = validateMeasurement(m)
+			}
+			got := violations(t, err)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateMeasurement() violations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,8 +6,19 @@
 #include <WiFi.h>
 #include <ArduinoJson.h>
 #include <HTTPClient.h>
+#include <time.h>
+#include "mbedtls/md.h"
 
 const char* serverName = "http://192.168.1.207/ruuvitag/measurements";
+// Path as ruuvitag-httpserver sees it, without the prefix of the reverse proxy. It is part of the signature.
+const char* serverPathAndQuery = "/measurements";
+
+//------------------------------------------
+//Request signing, leave the key empty when the server does not require a token.
+//Use the id and signing key printed by: ruuvitag-httpserver token create <name>
+const char* tokenId = "";
+const char* signingKey = "";
+//------------------------------------------
 
 //------------------------------------------
 //WIFI
@@ -25,6 +36,28 @@ bool new_data = false;
 bool debug = false;
 bool writeToDb = true;
 
+// signRequest computes hex(HMAC-SHA256(signingKey, timestamp + "\n" + method + "\n" + path + "\n" + body))
+String signRequest(const String& timestamp, const String& body) {
+  String message = timestamp + "\nPOST\n" + serverPathAndQuery + "\n" + body;
+  unsigned char hmac[32];
+
+  mbedtls_md_context_t ctx;
+  mbedtls_md_init(&ctx);
+  mbedtls_md_setup(&ctx, mbedtls_md_info_from_type(MBEDTLS_MD_SHA256), 1);
+  mbedtls_md_hmac_starts(&ctx, (const unsigned char*) signingKey, strlen(signingKey));
+  mbedtls_md_hmac_update(&ctx, (const unsigned char*) message.c_str(), message.length());
+  mbedtls_md_hmac_finish(&ctx, hmac);
+  mbedtls_md_free(&ctx);
+
+  String signature = "";
+  char hex[3];
+  for (int i = 0; i < 32; i++) {
+    sprintf(hex, "%02x", hmac[i]);
+    signature += hex;
+  }
+  return signature;
+}
+
 void blePeripheralDiscoveredHandler(BLEDevice central) {
   if(central.hasManufacturerData() && central.hasAdvertisementData()) {
     // Check PDF From: https://www.bluetooth.com/specifications/assigned-numbers/
@@ -130,6 +163,13 @@ void send_data() {
   String httpRequestData = "";
   serializeJson(doc, httpRequestData);
 
+  if (strlen(signingKey) > 0) {
+    String timestamp = String((unsigned long) time(nullptr));
+    http.addHeader("X-Token-Id", tokenId);
+    http.addHeader("X-Timestamp", timestamp);
+    http.addHeader("X-Signature", signRequest(timestamp, httpRequestData));
+  }
+
   // Send HTTP POST request
   int httpResponseCode = http.POST(httpRequestData);
   
@@ -164,6 +204,16 @@ void setup() {
   Serial.print("IP address: ");
   Serial.println(WiFi.localIP());
 
+  //Signed requests carry a timestamp, so the clock has to be set
+  if (strlen(signingKey) > 0) {
+    configTime(0, 0, "pool.ntp.org");
+    while (time(nullptr) < 1700000000) {
+      delay(500);
+      Serial.print("*");
+    }
+    Serial.println("");
+  }
+
   esp_sleep_enable_timer_wakeup(120 * 1000000); // deep sleep for 2 minutes
 
   if (!BLE.begin()) {
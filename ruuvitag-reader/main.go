@@ -169,6 +169,9 @@ func sendToRuuviHttp(t float64, h float64, p uint32, ax int16, ay int16, az int1
 	r := client.R()
 
 	r.SetHeader("Content-Type", "application/json")
+	if token := envFile["RUUVI_HTTP_SERVER_API_TOKEN"]; token != "" {
+		r.SetAuthToken(token)
+	}
 	r.SetBody(m)
 
 	resp, err := r.Post(url)